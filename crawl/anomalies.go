@@ -0,0 +1,100 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Kinds of Anomaly.
+const (
+	// More than -maxUnfollows followers went missing at once.
+	AnomalyMassUnfollow = "mass_unfollow"
+)
+
+// Anomaly is a crawl result that was too suspicious to act on. The user's
+// snapshot isn't updated and nobody is notified, so an operator can look
+// into it.
+type Anomaly struct {
+	Uid        int64  `bson:"uid"`
+	Kind       string `bson:"kind"`
+	DetectedAt int64  `bson:"detected"`
+	// Dates and sizes of the last saved snapshot and of the rejected one.
+	PrevSnapshotDate int64 `bson:"prevsnapshot"`
+	NewSnapshotDate  int64 `bson:"newsnapshot"`
+	PrevFollowers    int   `bson:"prevfollowers"`
+	NewFollowers     int   `bson:"newfollowers"`
+	// Missing is the number of followers in the old snapshot that aren't
+	// in the new one.
+	Missing int `bson:"missing"`
+	// Acknowledged is when an operator said the anomaly is real, or 0.
+	Acknowledged int64 `bson:"acknowledged"`
+}
+
+func (a *Anomaly) String() string {
+	s := fmt.Sprintf("%v: %v for %d, %d followers missing (%d followers at %v, %d at %v)",
+		time.Unix(a.DetectedAt, 0).UTC().Format(time.RFC3339), a.Kind, a.Uid, a.Missing,
+		a.PrevFollowers, time.Unix(a.PrevSnapshotDate, 0).UTC().Format(time.RFC3339),
+		a.NewFollowers, time.Unix(a.NewSnapshotDate, 0).UTC().Format(time.RFC3339))
+	if a.Acknowledged != 0 {
+		s += ", acknowledged at " + time.Unix(a.Acknowledged, 0).UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// AcknowledgeAnomaly tells the crawler that the anomalies found for uid are
+// real. They were found against the latest saved snapshot of uid, which the
+// quarantine kept: the next crawl compares against it again, and this time
+// it notifies the unfollows and saves the new snapshot. Later anomalies are
+// quarantined as usual.
+func AcknowledgeAnomaly(db FollowersStore, uid int64) error {
+	uf, err := db.GetUserFollowers(uid)
+	if err != nil {
+		return err
+	}
+	if uf == nil {
+		return fmt.Errorf("no followers snapshot for %d", uid)
+	}
+	if dryRunMode {
+		log.Printf("dryRunMode, not acknowledging the anomalies of %d", uid)
+		return nil
+	}
+	found, err := db.AcknowledgeAnomalies(uid, uf.Date, time.Now().UTC().Unix())
+	if err == nil && !found {
+		err = fmt.Errorf("no anomaly for the latest snapshot of %d", uid)
+	}
+	return err
+}
+
+// anomaliesByDate sorts anomalies by the time they were detected.
+type anomaliesByDate []*Anomaly
+
+func (a anomaliesByDate) Len() int           { return len(a) }
+func (a anomaliesByDate) Less(i, j int) bool { return a[i].DetectedAt < a[j].DetectedAt }
+func (a anomaliesByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MassUnfollowError is returned by DiffFollowers when too many followers of
+// Uid went missing for it to be believable.
+type MassUnfollowError struct {
+	Uid     int64
+	Missing int
+	Max     int
+}
+
+func (e *MassUnfollowError) Error() string {
+	return fmt.Sprintf("too many unfollows for user %v: %d > %d", e.Uid, e.Missing, e.Max)
+}
@@ -0,0 +1,116 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var resumeWithin time.Duration
+
+func init() {
+	flag.DurationVar(&resumeWithin, "resumeWithin", 12*time.Hour,
+		"A crawl that was interrupted less than this long ago is resumed, skipping the users it had finished.")
+}
+
+// CrawlRun is the progress of a crawl of all our users, saved as it goes so
+// that a crawl that dies can be resumed.
+type CrawlRun struct {
+	// Id is the time the run started.
+	Id int64 `bson:"id"`
+	// Finished is when the run ended, or 0 if it didn't.
+	Finished int64 `bson:"finished"`
+	// Current is the last user whose crawl started.
+	Current int64 `bson:"current"`
+}
+
+// startRun returns the run to record progress in, and the users that are
+// already done in it. An unfinished run started within -resumeWithin is
+// resumed, otherwise a new one is started. There is no run in dryRunMode.
+func (c *FollowersCrawler) startRun() (run *CrawlRun, done map[int64]bool) {
+	done = map[int64]bool{}
+	if dryRunMode {
+		return nil, done
+	}
+	last, err := c.db.LatestCrawlRun()
+	if err != nil {
+		log.Printf("LatestCrawlRun: %v", err)
+	}
+	if last != nil && last.Finished == 0 && time.Since(time.Unix(last.Id, 0)) < resumeWithin {
+		uids, err := c.db.CrawledUsers(last.Id)
+		if err == nil {
+			for _, uid := range uids {
+				done[uid] = true
+			}
+			log.Printf("Resuming the crawl started at %v: %d users done, stopped at %d",
+				time.Unix(last.Id, 0), len(done), last.Current)
+			return last, done
+		}
+		log.Printf("CrawledUsers(%d): %v", last.Id, err)
+	}
+	run = &CrawlRun{Id: time.Now().UTC().Unix()}
+	if last != nil && run.Id <= last.Id {
+		run.Id = last.Id + 1
+	}
+	if err := c.db.SaveCrawlRun(run); err != nil {
+		log.Printf("SaveCrawlRun: %v", err)
+		return nil, done
+	}
+	if err := c.db.ClearCrawledUsers(run.Id); err != nil {
+		log.Printf("ClearCrawledUsers: %v", err)
+	}
+	return run, done
+}
+
+// crawling records that run is now at uid.
+func (c *FollowersCrawler) crawling(run *CrawlRun, uid int64) {
+	if run == nil {
+		return
+	}
+	c.mu.Lock()
+	run.Current = uid
+	saved := *run
+	c.mu.Unlock()
+	if err := c.db.SaveCrawlRun(&saved); err != nil {
+		log.Printf("SaveCrawlRun: %v", err)
+	}
+}
+
+// crawled records that uid doesn't need to be crawled again in run.
+func (c *FollowersCrawler) crawled(run *CrawlRun, uid int64) {
+	if run == nil {
+		return
+	}
+	if err := c.db.MarkUserCrawled(run.Id, uid); err != nil {
+		log.Printf("MarkUserCrawled(%d, %d): %v", run.Id, uid, err)
+	}
+}
+
+// finishRun marks run as complete, so it won't be resumed.
+func (c *FollowersCrawler) finishRun(run *CrawlRun) {
+	if run == nil {
+		return
+	}
+	c.mu.Lock()
+	run.Finished = time.Now().UTC().Unix()
+	run.Current = 0
+	saved := *run
+	c.mu.Unlock()
+	if err := c.db.SaveCrawlRun(&saved); err != nil {
+		log.Printf("SaveCrawlRun: %v", err)
+	}
+}
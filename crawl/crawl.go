@@ -15,21 +15,28 @@
 package javaitarde
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 const maxErrors = 5
 
 var (
-	dryRunMode   bool
-	ignoredUsers string
-	maxUnfollows int
-	notifyUsers  bool
+	dryRunMode       bool
+	ignoredUsers     string
+	maxUnfollows     int
+	notifyUsers      bool
+	notifyRefollows  bool
+	notifyDeparted   bool
+	confirmUnfollows bool
+	screenNameTTL    time.Duration
+	crawlWorkers     int
 )
 
 func init() {
@@ -37,103 +44,391 @@ func init() {
 		"Don't make changes to the database.")
 	flag.BoolVar(&notifyUsers, "notifyUsers", true,
 		"Notify unfollows to users.")
-	flag.IntVar(&maxUnfollows, "maxUnfollows", 50, "Panic if the number of unfollows for a user exceeds this.")
-	// TODO(nictuku): Make this a list.
+	flag.BoolVar(&notifyRefollows, "notifyRefollows", false,
+		"Also tell users when someone who unfollowed them follows them again.")
+	flag.BoolVar(&notifyDeparted, "notifyDeparted", false,
+		"Tell users about followers whose account was suspended or deactivated. By default only real unfollows are notified.")
+	flag.BoolVar(&confirmUnfollows, "confirmUnfollows", true,
+		"Check each unfollow with friendships/show before notifying it, since followers/ids is sometimes incomplete.")
+	flag.DurationVar(&screenNameTTL, "screenNameTTL", 7*24*time.Hour,
+		"How long screen names are cached before being fetched from twitter again.")
+	flag.IntVar(&crawlWorkers, "workers", 1,
+		"Number of users crawled at the same time. They share the twitter API quota of each endpoint.")
+	flag.IntVar(&maxUnfollows, "maxUnfollows", 50,
+		"If more followers than this go missing at once, the user's crawl is set aside as an anomaly instead of notified.")
 	flag.StringVar(&ignoredUsers, "ignoreUsers", "118058049",
-		"UserID to ignore (flaky twitter results)")
+		"Comma separated UserIDs to ignore (flaky twitter results), in addition to the ones added with the ignore command.")
 }
 
 type FollowersCrawler struct {
 	ourUsers []int64
-	userMap  map[int64]string
-	db       *FollowersDatabase
+	db       FollowersStore
 	tw       *twitterClient
+	ignored  *ignoreList
+
+	// mu guards userMap and the CrawlRun, which are shared by the crawl
+	// workers.
+	mu      sync.Mutex
+	userMap map[int64]string
 }
 
-func NewFollowersCrawler() *FollowersCrawler {
+// NewFollowersCrawler returns a crawler that keeps its state in db.
+func NewFollowersCrawler(db FollowersStore) *FollowersCrawler {
 	return &FollowersCrawler{
 		tw:       newTwitterClient(),
-		db:       NewFollowersDatabase(),
+		db:       db,
 		ourUsers: make([]int64, 0),
 		userMap:  map[int64]string{},
+		ignored:  newIgnoreList(),
 	}
 }
 
 // Find everyone who follows us, so we know who to crawl.
-func (c *FollowersCrawler) FindOurUsers(uid int64) (err error) {
-	if err := c.tw.verifyCredentials(); err != nil {
+func (c *FollowersCrawler) FindOurUsers(ctx context.Context, uid int64) (err error) {
+	if err := c.tw.verifyCredentials(ctx); err != nil {
 		return err
 	}
-	uf, err := c.tw.getUserFollowers(uid, "")
+	uf, paged, err := c.fetchFollowers(ctx, uid)
 	if err != nil {
 		return err
 	}
 	if err := c.saveUserFollowers(uf); err != nil {
 		log.Printf("c.saveUserFollowers(), u=%v, err=%v", uid, err)
+	} else if paged {
+		c.deleteFollowersPages(uid)
 	}
 	c.ourUsers = uf.Followers
 	return
 }
 
-func (c *FollowersCrawler) GetAllUsersFollowers() (err error) {
+// GetAllUsersFollowers looks for unfollows of each of our users, notifies
+// them and saves their new followers snapshot. -workers users are crawled at
+// the same time. If ctx is canceled, it returns ctx.Err() once the users
+// being notified are done; the ones not notified yet are left as they were.
+// Progress is saved as it goes, and a crawl that didn't finish is resumed,
+// see startRun.
+func (c *FollowersCrawler) GetAllUsersFollowers(ctx context.Context) (err error) {
 	var (
-		prevUf     *userFollowers
-		newUf      *userFollowers
+		// mu guards errorCount and filtered.
+		mu sync.Mutex
+		// Consecutive errors.
 		errorCount = 0
+		// Unfollows that turned out to be false.
+		filtered = 0
 	)
-	for _, u := range c.ourUsers {
-		if errorCount >= maxErrors {
-			return errors.New(fmt.Sprintf("Too many errors (%d). Aborting GetAllUsersFollowers(). ", errorCount))
-		}
-		if prevUf, err = c.db.GetUserFollowers(u); err != nil {
-			log.Printf("GetAllUserFollowers err=%s, userId=%d\n", err.Error(), u)
-			// Give up if we can't read from the database.
-			// This assumes that a new user will return an empty
-			// value, without errors.
-			continue
+	if err := c.loadIgnoreList(); err != nil {
+		log.Printf("loadIgnoreList: %v", err)
+	}
+	defer func() {
+		if filtered > 0 {
+			log.Printf("%d unfollows were not confirmed by friendships/show", filtered)
 		}
-		if newUf, err = c.tw.getUserFollowers(u, ""); err != nil {
-			if strings.Contains(err.Error(), " 401") {
-				// User's follower list is blocked. Need to request access.
-				if err := c.FollowUser(u); err != nil {
-					log.Println("FollowUser:", err)
+	}()
+	run, done := c.startRun()
+
+	users := make(chan int64)
+	var wg sync.WaitGroup
+	workers := crawlWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range users {
+				r := c.crawlUser(ctx, run, u)
+				mu.Lock()
+				errorCount += r.errors
+				if r.saved {
+					errorCount = 0
 				}
-			} else {
-				log.Printf("TwitterGetUserFollowers err=%s, userId=%d\n", err.Error(), u)
-				errorCount += 1
+				filtered += r.filtered
+				mu.Unlock()
 			}
+		}()
+	}
+dispatch:
+	for _, u := range c.ourUsers {
+		if done[u] {
 			continue
 		}
-		if newUf == nil {
-			log.Println("No followers found in twitter for user", u)
-			errorCount += 1
-			continue
+		mu.Lock()
+		n := errorCount
+		mu.Unlock()
+		if n >= maxErrors {
+			err = errors.New(fmt.Sprintf("Too many errors (%d). Aborting GetAllUsersFollowers(). ", n))
+			break
 		}
-		for _, unfollower := range c.DiffFollowers(u, prevUf, newUf) {
-			if err := c.ProcessUnfollow(u, unfollower); err != nil {
-				log.Printf("ProcessUnfollow failure, userId=%d, unfollower=%v. Err: %v", u, unfollower, err)
-				errorCount += 1
-				continue
+		select {
+		case users <- u:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(users)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.finishRun(run)
+	return
+}
+
+// userCrawl is the outcome of crawlUser.
+type userCrawl struct {
+	// errors counts toward maxErrors.
+	errors int
+	// saved is true if the new snapshot was saved, which resets the
+	// error count.
+	saved bool
+	// filtered is the number of unfollows not confirmed by twitter.
+	filtered int
+}
+
+// crawlUser looks for unfollows of u, notifies them and saves the new
+// followers snapshot of u.
+func (c *FollowersCrawler) crawlUser(ctx context.Context, run *CrawlRun, u int64) (r userCrawl) {
+	c.crawling(run, u)
+	prevUf, err := c.db.GetUserFollowers(u)
+	if err != nil {
+		log.Printf("GetAllUserFollowers err=%s, userId=%d\n", err.Error(), u)
+		// Give up if we can't read from the database.
+		// This assumes that a new user will return an empty
+		// value, without errors.
+		var connErr *ConnectionError
+		if errors.As(err, &connErr) {
+			r.errors++
+		}
+		return
+	}
+	newUf, paged, err := c.fetchFollowers(ctx, u)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, NotAuthorizedError{}) {
+			// User's follower list is blocked. Need to request access.
+			if err := c.FollowUser(ctx, u); err != nil {
+				log.Println("FollowUser:", err)
 			}
+			c.crawled(run, u)
+		} else {
+			log.Printf("TwitterGetUserFollowers err=%s, userId=%d\n", err.Error(), u)
+			r.errors++
 		}
-		// Only save to DB if all went fine.
-		if err := c.saveUserFollowers(newUf); err != nil {
-			log.Printf("c.saveUserFollowers(), u=%d, err=%v", u, err)
-			errorCount += 1
+		return
+	}
+	if newUf == nil {
+		log.Println("No followers found in twitter for user", u)
+		r.errors++
+		return
+	}
+	added, unfollowers, diffErr := c.DiffFollowers(u, prevUf, newUf)
+	if diffErr != nil && !c.anomalyAcknowledged(u, prevUf) {
+		c.quarantine(u, prevUf, newUf, len(unfollowers), diffErr)
+		c.crawled(run, u)
+		return
+	}
+	unfollowers, suspected, suspectChanges := c.checkSuspected(u, newUf, unfollowers)
+	// Suspects stay in the snapshot until confirmed, so they are
+	// diffed again next time.
+	newUf.Followers = append(newUf.Followers, suspected...)
+	reasons := map[int64]string{}
+	if len(unfollowers) > 0 {
+		// Unfollowers are always looked up, to see if their account
+		// still exists. u's name is likely needed to notify them.
+		// Added followers are looked up only if someone is told
+		// about them, see processRefollows and processNewFollowers.
+		fetched, err := c.lookupUsers(ctx, append(c.uncachedUsers([]int64{u}), unfollowers...))
+		if err != nil {
+			log.Printf("lookupUsers failure, userId=%d. Err: %v", u, err)
+		} else {
+			reasons = c.departureReasons(ctx, unfollowers, fetched)
+		}
+	}
+	if confirmUnfollows {
+		var stillFollowing []int64
+		unfollowers, stillFollowing = c.confirmUnfollows(ctx, u, unfollowers, reasons)
+		r.filtered = len(stillFollowing)
+		// Keep them in the snapshot, or they'd look like new
+		// followers next time.
+		newUf.Followers = append(newUf.Followers, stillFollowing...)
+	}
+	if ctx.Err() != nil {
+		// Nobody was notified yet, so the next run can start over.
+		log.Printf("Interrupted, leaving the followers of %d for the next run", u)
+		return
+	}
+	// u is either left alone or fully done: once notifying starts, it
+	// finishes and the snapshot is saved, even if ctx is canceled.
+	// Otherwise the next run would notify the same changes again.
+	ctx = context.WithoutCancel(ctx)
+	for _, unfollower := range unfollowers {
+		e := &UnfollowEvent{
+			Uid:              u,
+			Unfollower:       unfollower,
+			DetectedAt:       time.Now().UTC().Unix(),
+			PrevSnapshotDate: prevUf.Date,
+			NewSnapshotDate:  newUf.Date,
+			Reason:           reasons[unfollower],
+		}
+		if err := c.ProcessUnfollow(ctx, e); err != nil {
+			log.Printf("ProcessUnfollow failure, userId=%d, unfollower=%v. Err: %v", u, unfollower, err)
+			r.errors++
 			continue
 		}
-		errorCount = 0
 	}
+	if len(added) > 0 {
+		c.processNewFollowers(ctx, u, c.processRefollows(ctx, u, added))
+	}
+	// Only save to DB if all went fine.
+	if err := c.saveUserFollowers(newUf); err != nil {
+		log.Printf("c.saveUserFollowers(), u=%d, err=%v", u, err)
+		r.errors++
+		return
+	}
+	c.saveSuspected(u, suspectChanges)
+	// Kept until now, so that a quarantine or a failure doesn't waste
+	// the fetch.
+	if paged {
+		c.deleteFollowersPages(u)
+	}
+	c.crawled(run, u)
+	r.saved = true
 	return
 }
 
-func (c *FollowersCrawler) getUserName(uid int64) (screenName string, err error) {
-	// TODO: Save in our database.
-	if screenName, ok := c.userMap[uid]; ok {
+// getUserName returns the screen name of uid. Names are cached in the
+// database for -screenNameTTL. If twitter can't tell the name, an expired
+// one from the cache is used.
+func (c *FollowersCrawler) getUserName(ctx context.Context, uid int64) (screenName string, err error) {
+	if screenName, ok := c.knownName(uid); ok {
+		return screenName, nil
+	}
+	_, err = c.resolveUsers(ctx, []int64{uid})
+	if screenName, ok := c.knownName(uid); ok {
 		return screenName, nil
 	}
-	if screenName, err = c.tw.getUserName(uid); err == nil {
-		c.userMap[uid] = screenName
+	cached, fetched, _ := c.db.GetScreenName(uid)
+	if cached == "" {
+		if err == nil {
+			err = fmt.Errorf("user %d not found", uid)
+		}
+		return "", err
+	}
+	log.Printf("getUserName(%d) failed, using the name from %v: %v", uid, time.Unix(fetched, 0), err)
+	return cached, nil
+}
+
+func (c *FollowersCrawler) knownName(uid int64) (screenName string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	screenName, ok = c.userMap[uid]
+	return
+}
+
+func (c *FollowersCrawler) setName(uid int64, screenName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userMap[uid] = screenName
+}
+
+// resolveUsers makes sure the screen names of uids are known, so that
+// getUserName doesn't need to go to twitter for them. Names that aren't
+// cached or expired are looked up in batches. It returns the profiles that
+// were fetched from twitter.
+func (c *FollowersCrawler) resolveUsers(ctx context.Context, uids []int64) (fetched map[int64]*twitterUser, err error) {
+	return c.lookupUsers(ctx, c.uncachedUsers(uids))
+}
+
+// uncachedUsers returns the uids whose screen name isn't known or has
+// expired.
+func (c *FollowersCrawler) uncachedUsers(uids []int64) (missing []int64) {
+	missing = make([]int64, 0, len(uids))
+	for _, uid := range uids {
+		if _, ok := c.knownName(uid); ok {
+			continue
+		}
+		cached, date, err := c.db.GetScreenName(uid)
+		if err != nil {
+			log.Printf("GetScreenName(%d): %v", uid, err)
+		}
+		if cached != "" && time.Since(time.Unix(date, 0)) < screenNameTTL {
+			c.setName(uid, cached)
+			continue
+		}
+		missing = append(missing, uid)
+	}
+	return
+}
+
+// lookupUsers fetches the profiles of uids from twitter and remembers their
+// screen names.
+func (c *FollowersCrawler) lookupUsers(ctx context.Context, uids []int64) (fetched map[int64]*twitterUser, err error) {
+	if len(uids) == 0 {
+		return
+	}
+	fetched, err = c.tw.lookupUsers(ctx, uids)
+	now := time.Now().UTC().Unix()
+	for uid, u := range fetched {
+		c.setName(uid, u.ScreenName)
+		if dryRunMode {
+			continue
+		}
+		if err := c.db.SaveScreenName(uid, u.ScreenName, now); err != nil {
+			log.Printf("SaveScreenName(%d): %v", uid, err)
+		}
+	}
+	return
+}
+
+// departureReasons tells why each of the unfollowers is gone, given the
+// profiles twitter returned for them. Accounts that users/lookup doesn't
+// know about are checked one by one.
+func (c *FollowersCrawler) departureReasons(ctx context.Context, unfollowers []int64, fetched map[int64]*twitterUser) map[int64]string {
+	reasons := make(map[int64]string, len(unfollowers))
+	for _, uid := range unfollowers {
+		if _, ok := fetched[uid]; ok {
+			reasons[uid] = ReasonUnfollowed
+			continue
+		}
+		reason, err := c.tw.accountState(ctx, uid)
+		if err != nil {
+			log.Printf("accountState(%d): %v", uid, err)
+			reason = ReasonNotFound
+		}
+		reasons[uid] = reason
+	}
+	return reasons
+}
+
+// confirmUnfollows checks with twitter that each of the unfollowers really
+// stopped following u. Followers whose account is gone aren't checked. It
+// returns the confirmed unfollowers, and the ones that are still following.
+func (c *FollowersCrawler) confirmUnfollows(ctx context.Context, u int64, unfollowers []int64, reasons map[int64]string) (confirmed, stillFollowing []int64) {
+	confirmed = make([]int64, 0, len(unfollowers))
+	for _, unfollower := range unfollowers {
+		if r := reasons[unfollower]; r != "" && r != ReasonUnfollowed {
+			confirmed = append(confirmed, unfollower)
+			continue
+		}
+		following, err := c.tw.isFollowing(ctx, unfollower, u)
+		if err != nil {
+			// Can't tell, so trust followers/ids.
+			log.Printf("isFollowing(%d, %d): %v", unfollower, u, err)
+			confirmed = append(confirmed, unfollower)
+			continue
+		}
+		if following {
+			log.Printf("%d is still following %d, ignoring the unfollow", unfollower, u)
+			stillFollowing = append(stillFollowing, unfollower)
+			continue
+		}
+		confirmed = append(confirmed, unfollower)
 	}
 	return
 }
@@ -152,11 +447,15 @@ func (c *FollowersCrawler) saveUserFollowers(uf *userFollowers) (err error) {
 	return
 }
 
-func (c *FollowersCrawler) DiffFollowers(abandonedUser int64, prevUf, newUf *userFollowers) (unfollowers []int64) {
-	if ignore, _ := strconv.ParseInt(ignoredUsers, 10, 64); ignore == abandonedUser {
+// DiffFollowers returns who started following abandonedUser between prevUf and
+// newUf, and who stopped. If more than -maxUnfollows stopped, it also returns
+// a *MassUnfollowError.
+func (c *FollowersCrawler) DiffFollowers(abandonedUser int64, prevUf, newUf *userFollowers) (added, unfollowers []int64, err error) {
+	if c.ignored.watched[abandonedUser] {
 		log.Println("(ignored)")
 		return
 	}
+	added = make([]int64, 0)
 	unfollowers = make([]int64, 0)
 
 	if prevUf == nil || prevUf.Followers == nil {
@@ -170,75 +469,265 @@ func (c *FollowersCrawler) DiffFollowers(abandonedUser int64, prevUf, newUf *use
 	fOld := prevUf.Followers
 	fNew := newUf.Followers
 
-	diff := len(fOld) - len(fNew)
-	if diff > maxUnfollows {
-		log.Fatalf("too many unfollows for user %v: %d > %d",
-			abandonedUser, diff, maxUnfollows)
-	}
-
 	newMap := map[int64]bool{}
 	for _, uid := range fNew {
 		newMap[uid] = true
 	}
+	oldMap := map[int64]bool{}
+	for _, uid := range fOld {
+		oldMap[uid] = true
+	}
 
-	// We don't care about new followers, only missing ones.
+	for _, follower := range fNew {
+		if !oldMap[follower] {
+			if c.ignored.unfollower[follower] {
+				continue
+			}
+			added = append(added, follower)
+		}
+	}
 	for _, unfollower := range fOld {
 		if unfollower < 184 {
 			log.Println("ERROR while comparing user ", strconv.FormatInt(abandonedUser, 10))
 			log.Println("ERROR: bogus uid found in old database: ", unfollower)
-			//panic("bogus uid" + strconv.Itoa64(uid.(int64)))
-			c.db.Reconnect()
 			continue
 		}
 		if _, ok := newMap[unfollower]; !ok {
-			if ignore, _ := strconv.ParseInt(ignoredUsers, 10, 64); ignore == unfollower {
+			if c.ignored.unfollower[unfollower] {
 				log.Println("(ignored)")
 				continue
 			}
 			unfollowers = append(unfollowers, unfollower)
 		}
 	}
+	// Count the missing ids rather than compare the lengths: new
+	// followers could hide a broken list.
+	if len(unfollowers) > maxUnfollows {
+		err = &MassUnfollowError{abandonedUser, len(unfollowers), maxUnfollows}
+	}
 	return
 }
 
-// Notify user and mark unfollow in the database.
-func (c *FollowersCrawler) ProcessUnfollow(abandonedUser int64, unfollower int64) (err error) {
-	// TODO: Remove after we start caching screen_name => id data.
-	if dryRunMode || !notifyUsers {
+// quarantine sets aside the crawl of u that found missing followers, after
+// DiffFollowers failed with err. Nobody is notified and the previous
+// snapshot is kept, so the next crawl compares against it again. An anomaly
+// is recorded for the operator.
+func (c *FollowersCrawler) quarantine(u int64, prevUf, newUf *userFollowers, missing int, err error) {
+	log.Printf("Quarantined the crawl of %d: %v. If it's real, acknowledge it with the anomalies command.", u, err)
+	if dryRunMode {
 		return
 	}
+	a := &Anomaly{
+		Uid:              u,
+		Kind:             AnomalyMassUnfollow,
+		DetectedAt:       time.Now().UTC().Unix(),
+		PrevSnapshotDate: prevUf.Date,
+		NewSnapshotDate:  newUf.Date,
+		PrevFollowers:    len(prevUf.Followers),
+		NewFollowers:     len(newUf.Followers),
+		Missing:          missing,
+	}
+	if err := c.db.RecordAnomaly(a); err != nil {
+		log.Printf("RecordAnomaly(%v): %v", a, err)
+	}
+}
+
+// anomalyAcknowledged tells whether an operator acknowledged the anomalies of
+// u found against prevUf, so that its crawl goes on instead of being
+// quarantined again.
+func (c *FollowersCrawler) anomalyAcknowledged(u int64, prevUf *userFollowers) bool {
+	acknowledged, err := c.db.AnomalyAcknowledged(u, prevUf.Date)
+	if err != nil {
+		log.Printf("AnomalyAcknowledged failure, userId=%d. Err: %v", u, err)
+		return false
+	}
+	if acknowledged {
+		log.Printf("The anomaly of %d was acknowledged, going on with its crawl", u)
+	}
+	return acknowledged
+}
 
-	if c.db.GetWasUnfollowNotified(abandonedUser, unfollower) {
+// Notify user and mark unfollow in the database. The event is added to the
+// unfollow history with the outcome of the notification.
+func (c *FollowersCrawler) ProcessUnfollow(ctx context.Context, e *UnfollowEvent) (err error) {
+	if dryRunMode {
+		return
+	}
+	abandonedUser, unfollower := e.Uid, e.Unfollower
+	if e.Reason == "" {
+		e.Reason = ReasonUnfollowed
+	}
+	departed := e.Reason != ReasonUnfollowed
+	switch {
+	case !notifyUsers:
+		e.Status = UnfollowNotNotified
+	case departed && !notifyDeparted:
+		log.Printf("%d is gone (%v), not notifying %d", unfollower, e.Reason, abandonedUser)
+		e.Status = UnfollowSuppressed
+	case c.db.GetWasUnfollowNotified(abandonedUser, unfollower):
 		log.Println("already notified. ignoring")
+		e.Status = UnfollowAlreadyNotified
+	default:
+		if departed {
+			err = c.NotifyDeparted(ctx, abandonedUser, unfollower, e.Reason)
+		} else {
+			err = c.NotifyUnfollower(ctx, abandonedUser, unfollower)
+		}
+		if err != nil {
+			e.Status = UnfollowNotifyFailed
+			break
+		}
+		e.Status = UnfollowNotified
+		err = c.db.MarkUnfollowNotified(abandonedUser, unfollower)
+	}
+	if rerr := c.db.RecordUnfollowEvent(e); rerr != nil {
+		log.Printf("RecordUnfollowEvent(%v): %v", e, rerr)
+	}
+	return
+}
+
+// processRefollows starts a new follow episode for each of the added
+// followers of u, so that they are notified again if they leave again. With
+// -notifyRefollows, u is told about the ones with a recorded unfollow, even
+// if it wasn't notified. It returns the added followers that weren't told
+// about.
+func (c *FollowersCrawler) processRefollows(ctx context.Context, u int64, added []int64) (others []int64) {
+	if dryRunMode {
+		return added
+	}
+	var refollowers []int64
+	for _, follower := range added {
+		wasUnfollower, err := c.db.MarkRefollow(u, follower)
+		if err != nil {
+			log.Printf("MarkRefollow failure, userId=%d, follower=%d. Err: %v", u, follower, err)
+		}
+		if !wasUnfollower {
+			others = append(others, follower)
+			continue
+		}
+		log.Printf("%d is following %d again", follower, u)
+		if !notifyUsers || !notifyRefollows {
+			others = append(others, follower)
+			continue
+		}
+		refollowers = append(refollowers, follower)
+	}
+	if len(refollowers) == 0 {
 		return
 	}
-	if err = c.NotifyUnfollower(abandonedUser, unfollower); err != nil {
-		return err
+	// Only the names that will be used.
+	if _, err := c.resolveUsers(ctx, append([]int64{u}, refollowers...)); err != nil {
+		log.Printf("resolveUsers failure, userId=%d. Err: %v", u, err)
 	}
-	if err = c.db.MarkUnfollowNotified(abandonedUser, unfollower); err != nil {
-		return err
+	for _, follower := range refollowers {
+		if err := c.NotifyRefollower(ctx, u, follower); err != nil {
+			log.Printf("NotifyRefollower failure, userId=%d, follower=%d. Err: %v", u, follower, err)
+		}
 	}
 	return
 }
 
-func (c *FollowersCrawler) NotifyUnfollower(abandonedUser, unfollower int64) (err error) {
-	abandonedName, err := c.getUserName(abandonedUser)
+// processNewFollowers tells u about their new followers, if u opted in.
+func (c *FollowersCrawler) processNewFollowers(ctx context.Context, u int64, followers []int64) {
+	if dryRunMode || !notifyUsers || len(followers) == 0 {
+		return
+	}
+	settings, err := c.db.GetUserSettings(u)
 	if err != nil {
-		log.Printf("c.getUserName(abandonedUser) err: %v", err)
+		log.Printf("GetUserSettings failure, userId=%d. Err: %v", u, err)
 		return
 	}
-	unfollowerName, err := c.getUserName(unfollower)
+	if settings.NewFollowers == NewFollowersOff {
+		return
+	}
+	// Their names are needed only now that u opted in.
+	if _, err := c.resolveUsers(ctx, append([]int64{u}, followers...)); err != nil {
+		log.Printf("resolveUsers failure, userId=%d. Err: %v", u, err)
+	}
+	switch settings.NewFollowers {
+	case NewFollowersEach:
+		for _, follower := range followers {
+			if err := c.NotifyNewFollowers(ctx, u, []int64{follower}); err != nil {
+				log.Printf("NotifyNewFollowers failure, userId=%d, follower=%d. Err: %v", u, follower, err)
+			}
+		}
+	case NewFollowersBatch:
+		if err := c.NotifyNewFollowers(ctx, u, followers); err != nil {
+			log.Printf("NotifyNewFollowers failure, userId=%d. Err: %v", u, err)
+		}
+	}
+}
+
+func (c *FollowersCrawler) NotifyUnfollower(ctx context.Context, abandonedUser, unfollower int64) (err error) {
+	abandonedName, err := c.getUserName(ctx, abandonedUser)
 	if err != nil {
-		log.Printf("c.getUserName(unfollower) err: %v", err)
+		log.Printf("c.getUserName(ctx, abandonedUser) err: %v", err)
+		return
+	}
+	unfollowerName, err := c.getUserName(ctx, unfollower)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, unfollower) err: %v", err)
 		return
 	}
 	if dryRunMode || !notifyUsers {
 		return
 	}
-	return c.tw.NotifyUnfollower(abandonedName, unfollowerName)
+	return c.tw.NotifyUnfollower(ctx, abandonedName, unfollowerName)
+}
+
+// NotifyDeparted tells abandonedUser that follower is gone because their
+// account was suspended or deactivated.
+func (c *FollowersCrawler) NotifyDeparted(ctx context.Context, abandonedUser, follower int64, reason string) (err error) {
+	abandonedName, err := c.getUserName(ctx, abandonedUser)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, abandonedUser) err: %v", err)
+		return
+	}
+	followerName, err := c.getUserName(ctx, follower)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, follower) err: %v", err)
+		return
+	}
+	return c.tw.NotifyDeparted(ctx, abandonedName, followerName, reason)
+}
+
+func (c *FollowersCrawler) NotifyRefollower(ctx context.Context, abandonedUser, follower int64) (err error) {
+	abandonedName, err := c.getUserName(ctx, abandonedUser)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, abandonedUser) err: %v", err)
+		return
+	}
+	followerName, err := c.getUserName(ctx, follower)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, follower) err: %v", err)
+		return
+	}
+	return c.tw.NotifyRefollower(ctx, abandonedName, followerName)
+}
+
+// NotifyNewFollowers sends a single message to user about all the followers.
+func (c *FollowersCrawler) NotifyNewFollowers(ctx context.Context, user int64, followers []int64) (err error) {
+	userName, err := c.getUserName(ctx, user)
+	if err != nil {
+		log.Printf("c.getUserName(ctx, user) err: %v", err)
+		return
+	}
+	names := make([]string, 0, len(followers))
+	for _, follower := range followers {
+		name, err := c.getUserName(ctx, follower)
+		if err != nil {
+			log.Printf("c.getUserName(ctx, follower) err: %v", err)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	return c.tw.NotifyNewFollowers(ctx, userName, names)
 }
 
-func (c *FollowersCrawler) FollowUser(uid int64) (err error) {
+func (c *FollowersCrawler) FollowUser(ctx context.Context, uid int64) (err error) {
 	if dryRunMode {
 		return
 	}
@@ -246,7 +735,7 @@ func (c *FollowersCrawler) FollowUser(uid int64) (err error) {
 		// Already trying to follow user. Skipping follow request.
 		return
 	}
-	if err = c.tw.FollowUser(uid); err == nil {
+	if err = c.tw.FollowUser(ctx, uid); err == nil {
 		c.db.MarkPendingFollow(uid)
 	}
 	return
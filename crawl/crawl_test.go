@@ -0,0 +1,916 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTwitter serves the subset of the twitter API used by the crawler.
+type fakeTwitter struct {
+	mu        sync.Mutex
+	followers map[int64][]int64
+	// messages holds the direct messages sent, as "screen_name: text".
+	messages []string
+	// lookups counts the users/lookup calls, and lookedUp has the uids
+	// they asked for.
+	lookups  int
+	lookedUp []int64
+	// gone maps accounts that no longer exist to the twitter error code
+	// users/show returns for them.
+	gone map[int64]int
+	// missing are followers that followers/ids leaves out, but that
+	// friendships/show still knows about.
+	missing map[int64]bool
+	// pageSize, if set, splits followers/ids in pages of this size.
+	pageSize int
+	// failCursor makes the next followers/ids request for this cursor
+	// fail.
+	failCursor int64
+	// pages counts the followers/ids calls.
+	pages int
+	// onMessage, if set, is called after each direct message.
+	onMessage func()
+}
+
+func (f *fakeTwitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	switch r.URL.Path {
+	case "/account/verify_credentials.json":
+		fmt.Fprint(w, "{}")
+	case "/users/lookup.json":
+		f.lookups++
+		var users []map[string]interface{}
+		for _, s := range strings.Split(r.Form.Get("user_id"), ",") {
+			id, _ := strconv.ParseInt(s, 10, 64)
+			f.lookedUp = append(f.lookedUp, id)
+			if _, ok := f.gone[id]; ok {
+				continue
+			}
+			users = append(users, map[string]interface{}{"id": id, "screen_name": fmt.Sprintf("user%d", id)})
+		}
+		json.NewEncoder(w).Encode(users)
+	case "/users/show.json":
+		uid, _ := strconv.ParseInt(r.Form.Get("user_id"), 10, 64)
+		code, ok := f.gone[uid]
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": uid, "screen_name": fmt.Sprintf("user%d", uid)})
+			break
+		}
+		status := http.StatusNotFound
+		if code == twitterUserSuspended {
+			status = http.StatusForbidden
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"errors":[{"message":"gone","code":%d}]}`, code)
+	case "/followers/ids.json":
+		f.pages++
+		cursor, _ := strconv.ParseInt(r.Form.Get("cursor"), 10, 64)
+		if f.failCursor != 0 && cursor == f.failCursor {
+			f.failCursor = 0
+			http.Error(w, `{"errors":[{"message":"Internal error","code":131}]}`, http.StatusInternalServerError)
+			break
+		}
+		var ids []int64
+		for _, uid := range f.followers[id] {
+			if !f.missing[uid] {
+				ids = append(ids, uid)
+			}
+		}
+		next := 0
+		if f.pageSize > 0 {
+			start := int(cursor)
+			if start < 0 {
+				start = 0
+			}
+			if end := start + f.pageSize; end < len(ids) {
+				ids, next = ids[start:end], end
+			} else {
+				ids = ids[start:]
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ids": ids, "next_cursor": next})
+	case "/friendships/show.json":
+		source, _ := strconv.ParseInt(r.Form.Get("source_id"), 10, 64)
+		target, _ := strconv.ParseInt(r.Form.Get("target_id"), 10, 64)
+		following := false
+		for _, uid := range f.followers[target] {
+			following = following || uid == source
+		}
+		fmt.Fprintf(w, `{"relationship":{"source":{"following":%v}}}`, following)
+	case "/direct_messages/new.json":
+		f.messages = append(f.messages, r.Form.Get("screen_name")+": "+r.Form.Get("text"))
+		if f.onMessage != nil {
+			f.onMessage()
+		}
+		fmt.Fprint(w, "{}")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestCrawler returns a crawler backed by a MemoryDatabase and talking to
+// a fakeTwitter. Database writes and notifications are enabled while the
+// test runs.
+func newTestCrawler(t *testing.T) (*FollowersCrawler, *MemoryDatabase, *fakeTwitter) {
+	dry, notify := dryRunMode, notifyUsers
+	dryRunMode, notifyUsers = false, true
+	ft := &fakeTwitter{followers: map[int64][]int64{}, gone: map[int64]int{}, missing: map[int64]bool{}}
+	srv := httptest.NewServer(ft)
+	t.Cleanup(func() {
+		srv.Close()
+		dryRunMode, notifyUsers = dry, notify
+	})
+	db := NewMemoryDatabase()
+	c := NewFollowersCrawler(db)
+	c.tw.apiBase = srv.URL
+	return c, db, ft
+}
+
+func TestDiffFollowers(t *testing.T) {
+	c, _, _ := newTestCrawler(t)
+	tests := []struct {
+		prev, new          []int64
+		added, unfollowers []int64
+	}{
+		{[]int64{1000, 2000, 3000}, []int64{1000, 2000, 3000}, []int64{}, []int64{}},
+		{[]int64{1000, 2000, 3000}, []int64{1000, 3000}, []int64{}, []int64{2000}},
+		{[]int64{1000, 2000}, []int64{1000, 4000, 5000}, []int64{4000, 5000}, []int64{2000}},
+		// Bogus uids are skipped.
+		{[]int64{1000, 5}, []int64{1000}, []int64{}, []int64{}},
+		{nil, []int64{1000}, []int64{}, []int64{}},
+	}
+	for i, tt := range tests {
+		prev := &userFollowers{testExistingUser, 1, tt.prev}
+		added, unfollowers, err := c.DiffFollowers(testExistingUser, prev, &userFollowers{testExistingUser, 2, tt.new})
+		if err != nil {
+			t.Errorf("#%d DiffFollowers(%v, %v): %v", i, tt.prev, tt.new, err)
+		}
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(unfollowers, tt.unfollowers) {
+			t.Errorf("#%d DiffFollowers(%v, %v) = %v, %v, want %v, %v",
+				i, tt.prev, tt.new, added, unfollowers, tt.added, tt.unfollowers)
+		}
+	}
+}
+
+func TestProcessUnfollow(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	for i := 0; i < 2; i++ {
+		e := &UnfollowEvent{Uid: 1000, Unfollower: 2000, DetectedAt: int64(10 + i), PrevSnapshotDate: 1, NewSnapshotDate: 2}
+		if err := c.ProcessUnfollow(context.Background(), e); err != nil {
+			t.Fatalf("#%d ProcessUnfollow: %v", i, err)
+		}
+	}
+	if len(ft.messages) != 1 {
+		t.Fatalf("expected exactly one notification, got %q", ft.messages)
+	}
+	if !db.GetWasUnfollowNotified(1000, 2000) {
+		t.Error("unfollow wasn't marked as notified")
+	}
+
+	events, err := db.UnfollowEventsByUnfollower(2000, time.Unix(0, 0), time.Unix(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status []string
+	for _, e := range events {
+		status = append(status, e.Status)
+	}
+	if want := []string{UnfollowNotified, UnfollowAlreadyNotified}; !reflect.DeepEqual(status, want) {
+		t.Errorf("history: got %v, want %v", status, want)
+	}
+	if events, _ := db.UnfollowEventsByUser(1000, time.Unix(11, 0), time.Unix(100, 0)); len(events) != 1 {
+		t.Errorf("UnfollowEventsByUser in a time range: got %v, want 1 event", events)
+	}
+}
+
+func TestGetAllUsersFollowers(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000, 4000}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000, 4000, 5000}
+
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Xiiii.. você não está mais sendo seguido por @user3000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("notifications: got %q, want %q", ft.messages, want)
+	}
+	uf, err := db.GetUserFollowers(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uf == nil || !reflect.DeepEqual(uf.Followers, ft.followers[1000]) {
+		t.Errorf("latest snapshot: got %v, want followers %v", uf, ft.followers[1000])
+	}
+}
+
+func TestDepartedAccounts(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000, 4000, 5000}}); err != nil {
+		t.Fatal(err)
+	}
+	// Names known from earlier runs.
+	for _, uid := range []int64{3000, 4000} {
+		if err := db.SaveScreenName(uid, fmt.Sprintf("user%d", uid), time.Now().Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ft.gone[3000] = twitterUserSuspended
+	ft.gone[4000] = twitterUserNotFound
+	ft.followers[1000] = []int64{2000}
+
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Xiiii.. você não está mais sendo seguido por @user5000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	events, err := db.UnfollowEventsByUser(1000, time.Unix(0, 0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[int64]string{}
+	for _, e := range events {
+		if e.Reason != ReasonUnfollowed && e.Status != UnfollowSuppressed {
+			t.Errorf("%d left for %v but wasn't suppressed: %v", e.Unfollower, e.Reason, e.Status)
+		}
+		reasons[e.Unfollower] = e.Reason
+	}
+	wantReasons := map[int64]string{3000: ReasonSuspended, 4000: ReasonDeactivated, 5000: ReasonUnfollowed}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("reasons: got %v, want %v", reasons, wantReasons)
+	}
+
+	// Now with messages for departed accounts.
+	defer func(n bool) { notifyDeparted = n }(notifyDeparted)
+	notifyDeparted = true
+	e := &UnfollowEvent{Uid: 1000, Unfollower: 3000, Reason: ReasonSuspended}
+	if err := c.ProcessUnfollow(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 2 || ft.messages[1] != "user1000: A conta de @user3000 foi suspensa pelo twitter, por isso não está mais te seguindo." {
+		t.Errorf("expected a suspension notification, got %q", ft.messages)
+	}
+}
+
+func TestConfirmUnfollows(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000, 4000}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000, 3000}
+	ft.missing[3000] = true
+
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Xiiii.. você não está mais sendo seguido por @user4000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	uf, err := db.GetUserFollowers(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uf == nil || len(uf.Followers) != 2 {
+		t.Errorf("the unconfirmed unfollower should stay in the snapshot, got %v", uf)
+	}
+}
+
+func TestUnfollowConfirmations(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(n int) { unfollowConfirmations = n }(unfollowConfirmations)
+	unfollowConfirmations = 2
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	// Missing once, then back, then missing twice in a row.
+	for i, followers := range [][]int64{{2000}, {2000, 3000}, {2000}} {
+		ft.followers[1000] = followers
+		if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if len(ft.messages) != 0 {
+			t.Fatalf("#%d: unconfirmed unfollow notified: %q", i, ft.messages)
+		}
+	}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Xiiii.. você não está mais sendo seguido por @user3000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	if suspects, _ := db.SuspectedUnfollows(1000); len(suspects) != 0 {
+		t.Errorf("confirmed unfollow still suspected: %v", suspects)
+	}
+}
+
+// failingInsert is a store that can't save snapshots.
+type failingInsert struct {
+	*MemoryDatabase
+}
+
+func (failingInsert) Insert(uf *userFollowers) error {
+	return errors.New("disk full")
+}
+
+func TestSuspectsSavedWithSnapshot(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(n int) { unfollowConfirmations = n }(unfollowConfirmations)
+	unfollowConfirmations = 2
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000}
+	// Crawls whose snapshot couldn't be saved don't count.
+	c.db = failingInsert{db}
+	for i := 0; i < 2; i++ {
+		if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if len(ft.messages) != 0 {
+		t.Fatalf("unfollow notified after unsaved crawls: %q", ft.messages)
+	}
+	if suspects, _ := db.SuspectedUnfollows(1000); len(suspects) != 0 {
+		t.Errorf("unsaved crawls were counted: %v", suspects)
+	}
+	c.db = db
+	for i := 0; i < 2; i++ {
+		if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if len(ft.messages) != 1 {
+		t.Errorf("expected the unfollow after two saved crawls, got %q", ft.messages)
+	}
+
+	// Suspects left when -unfollowConfirmations is lowered are notified
+	// and forgotten.
+	ft.messages = nil
+	ft.followers[1000] = []int64{5000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if suspects, _ := db.SuspectedUnfollows(1000); len(suspects) != 1 {
+		t.Fatalf("suspects = %v, want @user2000", suspects)
+	}
+	unfollowConfirmations = 1
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 1 {
+		t.Errorf("expected the suspected unfollow to be notified, got %q", ft.messages)
+	}
+	if suspects, _ := db.SuspectedUnfollows(1000); len(suspects) != 0 {
+		t.Errorf("suspects left after lowering -unfollowConfirmations: %v", suspects)
+	}
+}
+
+func TestMassUnfollowQuarantine(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(m int) { maxUnfollows = m }(maxUnfollows)
+	maxUnfollows = 1
+	c.ourUsers = []int64{1000, 1001}
+	for _, u := range c.ourUsers {
+		if err := db.Insert(&userFollowers{u, 1, []int64{2000, 3000, 4000}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// More followers than before, but two of them are missing.
+	ft.followers[1000] = []int64{2000, 5000, 6000, 7000}
+	ft.followers[1001] = []int64{2000, 3000}
+
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1001: Xiiii.. você não está mais sendo seguido por @user4000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	uf, err := db.GetUserFollowers(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uf == nil || uf.Date != 1 {
+		t.Errorf("the quarantined snapshot was saved: %v", uf)
+	}
+	anomalies, err := db.Anomalies(time.Unix(0, 0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies) != 1 || anomalies[0].Uid != 1000 || anomalies[0].Missing != 2 {
+		t.Errorf("expected one anomaly for 1000 with 2 missing, got %v", anomalies)
+	}
+
+	// Without an acknowledgement, it's quarantined again.
+	ft.messages = nil
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 0 {
+		t.Errorf("unacknowledged anomaly notified: %q", ft.messages)
+	}
+	if err := AcknowledgeAnomaly(db, 1001); err == nil {
+		t.Error("acknowledged a user without anomalies")
+	}
+	if err := AcknowledgeAnomaly(db, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 2 {
+		t.Errorf("expected the 2 acknowledged unfollows to be notified, got %q", ft.messages)
+	}
+	if uf, _ := db.GetUserFollowers(1000); uf == nil || uf.Date == 1 {
+		t.Errorf("the acknowledged snapshot wasn't saved: %v", uf)
+	}
+	// The acknowledgement was for that snapshot only.
+	ft.followers[1000] = []int64{2000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 2 {
+		t.Errorf("a new anomaly was notified: %q", ft.messages)
+	}
+}
+
+func TestIgnoreList(t *testing.T) {
+	defer func(u string) { ignoredUsers = u }(ignoredUsers)
+	ignoredUsers = "5000, 6000"
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000, 1001}
+	for _, u := range c.ourUsers {
+		if err := db.Insert(&userFollowers{u, 1, []int64{2000, 3000, 4000, 5000, 6000}}); err != nil {
+			t.Fatal(err)
+		}
+		ft.followers[u] = []int64{2000}
+	}
+	if err := AddIgnore(db, 3000, IgnoreUnfollower); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddIgnore(db, 1001, IgnoreWatched); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddIgnore(db, 1001, "everything"); err == nil {
+		t.Error("AddIgnore accepted an unknown scope")
+	}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Xiiii.. você não está mais sendo seguido por @user4000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+
+	if err := RemoveIgnore(db, 3000, IgnoreUnfollower); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := db.IgnoreList(); !reflect.DeepEqual(entries, []*IgnoreEntry{{1001, IgnoreWatched}}) {
+		t.Errorf("IgnoreList() = %v after RemoveIgnore", entries)
+	}
+}
+
+func TestIsStatus(t *testing.T) {
+	err := fmt.Errorf("lookup: %w", &twitterAPIError{StatusCode: 404, Msg: "[No user matches]"})
+	if !isStatus(err, http.StatusNotFound) {
+		t.Errorf("isStatus(%v, 404) = false", err)
+	}
+	if isStatus(err, http.StatusUnauthorized) {
+		t.Errorf("isStatus(%v, 401) = true", err)
+	}
+	// Numbers in other errors don't count.
+	if err := errors.New("read tcp 10.0.0.1: 404 bytes"); isStatus(err, http.StatusNotFound) {
+		t.Errorf("isStatus(%v, 404) = true", err)
+	}
+}
+
+func TestInterruptedCrawl(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.GetAllUsersFollowers(ctx); err != context.Canceled {
+		t.Errorf("GetAllUsersFollowers = %v, want %v", err, context.Canceled)
+	}
+	if uf, _ := db.GetUserFollowers(1000); uf == nil || uf.Date != 1 {
+		t.Errorf("interrupted crawl saved a snapshot: %v", uf)
+	}
+
+	// A rate limit sleep ends with the context.
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("X-Rate-Limit-Remaining", "0")
+	resp.Header.Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	l := newRateLimiter()
+	l.update("/followers/ids.json", resp, false)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.wait(ctx, "/followers/ids.json"); err != context.DeadlineExceeded {
+		t.Errorf("wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Other endpoints have their own quota.
+	if _, err := l.wait(context.Background(), "/users/lookup.json"); err != nil {
+		t.Errorf("wait(/users/lookup.json) = %v", err)
+	}
+}
+
+func rateLimitResponse(remaining int64, reset time.Time) *http.Response {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("X-Rate-Limit-Remaining", strconv.FormatInt(remaining, 10))
+	resp.Header.Set("X-Rate-Limit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return resp
+}
+
+func TestRateLimiter(t *testing.T) {
+	const endpoint = "/followers/ids.json"
+	blocked := func(l *rateLimiter) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := l.wait(ctx, endpoint)
+		return err == context.DeadlineExceeded
+	}
+
+	// While the quota is unknown, one request finds it out.
+	l := newRateLimiter()
+	probe, err := l.wait(context.Background(), endpoint)
+	if err != nil || !probe {
+		t.Fatalf("first wait = %v, %v; want a probe", probe, err)
+	}
+	if !blocked(l) {
+		t.Error("a second request went through before the quota was known")
+	}
+	// A failed probe lets the next request find it out.
+	l.update(endpoint, nil, probe)
+	if probe, err = l.wait(context.Background(), endpoint); err != nil || !probe {
+		t.Fatalf("wait after a failed probe = %v, %v; want a probe", probe, err)
+	}
+	reset := time.Now().Add(time.Hour)
+	l.update(endpoint, rateLimitResponse(2, reset), probe)
+
+	// A late response with a higher count doesn't give the quota back.
+	l.update(endpoint, rateLimitResponse(1, reset), false)
+	l.update(endpoint, rateLimitResponse(5, reset), false)
+	// Neither does one from the previous window.
+	l.update(endpoint, rateLimitResponse(9, reset.Add(-time.Hour)), false)
+	if probe, err = l.wait(context.Background(), endpoint); err != nil || probe {
+		t.Fatalf("wait = %v, %v", probe, err)
+	}
+	if !blocked(l) {
+		t.Error("the quota was used up but a request went through")
+	}
+}
+
+func TestInterruptedNotifications(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNewFollowersMode(db, 1000, NewFollowersEach); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000, 4000, 5000}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ft.onMessage = cancel
+	if err := c.GetAllUsersFollowers(ctx); err != context.Canceled {
+		t.Errorf("GetAllUsersFollowers = %v, want %v", err, context.Canceled)
+	}
+	ft.onMessage = nil
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The user was finished after the interruption, and not notified
+	// again by the next run.
+	want := []string{
+		"user1000: Xiiii.. você não está mais sendo seguido por @user3000 :-(.",
+		"user1000: Oba! @user4000 começou a te seguir :-).",
+		"user1000: Oba! @user5000 começou a te seguir :-).",
+	}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+}
+
+func TestResumeCrawl(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000, 1001}
+	for _, u := range c.ourUsers {
+		if err := db.Insert(&userFollowers{u, 1, []int64{2000, 3000}}); err != nil {
+			t.Fatal(err)
+		}
+		ft.followers[u] = []int64{2000}
+	}
+	// A crawl died after finishing 1000.
+	run := &CrawlRun{Id: time.Now().Add(-time.Hour).Unix(), Current: 1001}
+	if err := db.SaveCrawlRun(run); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MarkUserCrawled(run.Id, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1001: Xiiii.. você não está mais sendo seguido por @user3000 :-(."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	if latest, _ := db.LatestCrawlRun(); latest == nil || latest.Id != run.Id || latest.Finished == 0 {
+		t.Errorf("the resumed run wasn't finished: %+v", latest)
+	}
+
+	// The next crawl starts over.
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 2 || ft.messages[1] != "user1000: Xiiii.. você não está mais sendo seguido por @user3000 :-(." {
+		t.Errorf("expected 1000 to be crawled by a new run, got %q", ft.messages)
+	}
+}
+
+func TestFollowersPages(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000}}); err != nil {
+		t.Fatal(err)
+	}
+	for uid := int64(2000); uid < 2010; uid++ {
+		ft.followers[1000] = append(ft.followers[1000], uid)
+	}
+	ft.pageSize = 3
+	ft.failCursor = 6
+
+	c.GetAllUsersFollowers(context.Background())
+	if pages, _ := db.FollowersPages(1000); len(pages) != 2 {
+		t.Fatalf("expected the 2 pages fetched before the error to be saved, got %d", len(pages))
+	}
+	if uf, _ := db.GetUserFollowers(1000); uf.Date != 1 {
+		t.Errorf("a partial follower list was saved: %v", uf)
+	}
+
+	// The list is complete now, but the snapshot can't be saved.
+	c.db = failingInsert{db}
+	ft.pages = 0
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ft.pages != 2 {
+		t.Errorf("expected the 2 missing pages to be fetched, got %d requests", ft.pages)
+	}
+	if pages, _ := db.FollowersPages(1000); len(pages) != 3 {
+		t.Fatalf("expected the pages to be kept until the snapshot is saved, got %d", len(pages))
+	}
+
+	c.db = db
+	ft.pages = 0
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ft.pages != 1 {
+		t.Errorf("expected only the last page to be fetched, got %d requests", ft.pages)
+	}
+	uf, err := db.GetUserFollowers(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uf.Followers, ft.followers[1000]) {
+		t.Errorf("got followers %v, want %v", uf.Followers, ft.followers[1000])
+	}
+	if pages, _ := db.FollowersPages(1000); len(pages) != 0 {
+		t.Errorf("%d pages left after the snapshot was saved", len(pages))
+	}
+}
+
+func TestConcurrentCrawl(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(w int) { crawlWorkers = w }(crawlWorkers)
+	crawlWorkers = 4
+	var want []string
+	for u := int64(1000); u < 1010; u++ {
+		c.ourUsers = append(c.ourUsers, u)
+		if err := db.Insert(&userFollowers{u, 1, []int64{2000, 3000}}); err != nil {
+			t.Fatal(err)
+		}
+		ft.followers[u] = []int64{2000}
+		want = append(want, fmt.Sprintf("user%d: Xiiii.. você não está mais sendo seguido por @user3000 :-(.", u))
+	}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ft.messages)
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+	for _, u := range c.ourUsers {
+		if uf, _ := db.GetUserFollowers(u); uf == nil || uf.Date == 1 {
+			t.Errorf("the snapshot of %d wasn't saved: %v", u, uf)
+		}
+	}
+}
+
+func TestUnfollowAfterRefollow(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	// Unfollow, refollow, unfollow again.
+	for i, followers := range [][]int64{{2000}, {2000, 3000}, {2000}} {
+		ft.followers[1000] = followers
+		if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if len(ft.messages) != 2 {
+		t.Errorf("expected one notification per follow episode, got %q", ft.messages)
+	}
+
+	// Come back again, now with refollow notifications.
+	defer func(n bool) { notifyRefollows = n }(notifyRefollows)
+	notifyRefollows = true
+	ft.followers[1000] = []int64{2000, 3000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 3 || ft.messages[2] != "user1000: Oba! @user3000 voltou a te seguir :-)." {
+		t.Errorf("expected a refollow notification, got %q", ft.messages)
+	}
+
+	// Unfollows that weren't notified count too.
+	notifyUsers = false
+	ft.followers[1000] = []int64{3000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	notifyUsers = true
+	ft.followers[1000] = []int64{2000, 3000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 4 || ft.messages[3] != "user1000: Oba! @user2000 voltou a te seguir :-)." {
+		t.Errorf("expected a refollow notification after an unnotified unfollow, got %q", ft.messages)
+	}
+}
+
+func TestLookupOnlyNotified(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(n bool) { notifyRefollows = n }(notifyRefollows)
+	notifyRefollows = true
+	c.ourUsers = []int64{1000}
+	if err := db.Insert(&userFollowers{1000, 1, []int64{2000, 3000}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = []int64{2000}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 3000 comes back, with new followers nobody will be told about.
+	ft.lookedUp = nil
+	ft.followers[1000] = []int64{2000, 3000, 4000, 4001}
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 2 {
+		t.Errorf("expected an unfollow and a refollow notification, got %q", ft.messages)
+	}
+	// 1000 and 3000 are already known.
+	if len(ft.lookedUp) != 0 {
+		t.Errorf("looked up %v, want nobody", ft.lookedUp)
+	}
+
+	// Once 1000 opts in, the new followers are looked up together.
+	if err := SetNewFollowersMode(db, 1000, NewFollowersEach); err != nil {
+		t.Fatal(err)
+	}
+	ft.lookups = 0
+	ft.followers[1000] = append(ft.followers[1000], 5000, 5001)
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{5000, 5001}; ft.lookups != 1 || !reflect.DeepEqual(ft.lookedUp, want) {
+		t.Errorf("%d lookups of %v, want 1 of %v", ft.lookups, ft.lookedUp, want)
+	}
+}
+
+func TestNewFollowers(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	c.ourUsers = []int64{1000, 1001}
+	for _, u := range c.ourUsers {
+		if err := db.Insert(&userFollowers{u, 1, []int64{2000}}); err != nil {
+			t.Fatal(err)
+		}
+		ft.followers[u] = []int64{2000, 3000, 4000}
+	}
+	if err := SetNewFollowersMode(db, 1000, NewFollowersBatch); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNewFollowersMode(db, 1000, "sometimes"); err == nil {
+		t.Error("SetNewFollowersMode accepted an unknown mode")
+	}
+	// 1001 didn't opt in.
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user1000: Oba! Novos seguidores: @user3000, @user4000 :-)."}
+	if !reflect.DeepEqual(ft.messages, want) {
+		t.Errorf("got %q, want %q", ft.messages, want)
+	}
+}
+
+func TestScreenNameCache(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	if name, err := c.getUserName(context.Background(), 2000); err != nil || name != "user2000" {
+		t.Fatalf("getUserName(2000) = %q, %v", name, err)
+	}
+	// A new run uses the database.
+	c2 := NewFollowersCrawler(db)
+	c2.tw = c.tw
+	if name, err := c2.getUserName(context.Background(), 2000); err != nil || name != "user2000" {
+		t.Fatalf("getUserName(2000) = %q, %v", name, err)
+	}
+	if ft.lookups != 1 {
+		t.Errorf("expected 1 users/lookup call, got %d", ft.lookups)
+	}
+
+	// Expired names are fetched again.
+	stale := time.Now().Add(-2 * screenNameTTL).Unix()
+	if err := db.SaveScreenName(2000, "oldname", stale); err != nil {
+		t.Fatal(err)
+	}
+	c3 := NewFollowersCrawler(db)
+	c3.tw = c.tw
+	if name, err := c3.getUserName(context.Background(), 2000); err != nil || name != "user2000" {
+		t.Errorf("getUserName(2000) = %q, %v, want the refreshed name", name, err)
+	}
+	if ft.lookups != 2 {
+		t.Errorf("expected 2 users/lookup calls, got %d", ft.lookups)
+	}
+}
+
+func TestBatchedLookups(t *testing.T) {
+	c, db, ft := newTestCrawler(t)
+	defer func(m int) { maxUnfollows = m }(maxUnfollows)
+	maxUnfollows = 200
+	c.ourUsers = []int64{1000}
+	var followers []int64
+	for uid := int64(2000); uid < 2150; uid++ {
+		followers = append(followers, uid)
+	}
+	if err := db.Insert(&userFollowers{1000, 1, followers}); err != nil {
+		t.Fatal(err)
+	}
+	ft.followers[1000] = followers[:10]
+	if err := c.GetAllUsersFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ft.messages) != 140 {
+		t.Errorf("expected 140 notifications, got %d", len(ft.messages))
+	}
+	// 141 users, at most 100 per call.
+	if ft.lookups != 2 {
+		t.Errorf("expected 2 users/lookup calls, got %d", ft.lookups)
+	}
+}
@@ -15,10 +15,13 @@
 package javaitarde
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/garyburd/go-mongo/mongo"
 	"log"
-	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,6 +35,16 @@ const (
 	USER_FOLLOWERS_COUNTERS_TABLE = "user_followers_counters"
 	FOLLOW_PENDING_TABLE          = "follow_pending"
 	PREVIOUS_UNFOLLOWS_TABLE      = "previous_unfollows"
+	SCHEMA_VERSION_TABLE          = "schema_version"
+	UNFOLLOW_EVENTS_TABLE         = "unfollow_events"
+	USER_SETTINGS_TABLE           = "user_settings"
+	SCREEN_NAMES_TABLE            = "screen_names"
+	SUSPECTED_UNFOLLOWS_TABLE     = "suspected_unfollows"
+	ANOMALIES_TABLE               = "anomalies"
+	IGNORE_LIST_TABLE             = "ignore_list"
+	CRAWL_RUNS_TABLE              = "crawl_runs"
+	CRAWL_PROGRESS_TABLE          = "crawl_progress"
+	FOLLOWERS_PAGES_TABLE         = "followers_pages"
 )
 
 func init() {
@@ -41,38 +54,144 @@ func init() {
 		"Log all mongo queries.")
 }
 
+// FollowersDatabase is a FollowersStore backed by MongoDB.
+//
+// Operations that fail because the connection broke are retried after
+// reconnecting, with exponential backoff, except for inserts, which could
+// be saved twice. If the server stays unreachable, or an insert's connection
+// broke, they return a *ConnectionError. Operations are serialized, so it can be
+// used by several crawl workers.
 type FollowersDatabase struct {
+	// mu is held during each operation, since the connection isn't safe
+	// for concurrent use, and while the connection is replaced.
+	mu sync.Mutex
+	// dialMu is held while reconnecting, which can take a while.
+	dialMu sync.Mutex
+	// ctx bounds the reconnection attempts.
+	ctx                  context.Context
+	conn                 mongo.Conn
 	userFollowers        mongo.Collection
 	userFollowersCounter mongo.Collection
 	followPending        mongo.Collection
 	previousUnfollows    mongo.Collection
+	schemaVersion        mongo.Collection
+	unfollowEvents       mongo.Collection
+	userSettings         mongo.Collection
+	screenNames          mongo.Collection
+	suspectedUnfollows   mongo.Collection
+	anomalies            mongo.Collection
+	ignoreList           mongo.Collection
+	crawlRuns            mongo.Collection
+	crawlProgress        mongo.Collection
+	followersPages       mongo.Collection
 }
 
-func NewFollowersDatabase() *FollowersDatabase {
-	conn, err := mongo.Dial("127.0.0.1:27017")
+// NewFollowersDatabase connects to the server set by -mongoURI. Once ctx is
+// done, connection attempts are abandoned.
+func NewFollowersDatabase(ctx context.Context) (*FollowersDatabase, error) {
+	conn, err := dialMongoRetrying(ctx)
 	if err != nil {
-		log.Println("mongo Connect error:", err.Error())
-		panic("mongo conn err")
-	}
-	if verboseMongo {
-		conn = mongo.NewLoggingConn(conn, log.New(os.Stderr, "", 0), "")
+		return nil, err
 	}
+	c := &FollowersDatabase{ctx: ctx}
+	c.setConn(conn)
+	return c, nil
+}
+
+func (c *FollowersDatabase) setConn(conn mongo.Conn) {
 	db := mongo.Database{conn, DbName, mongo.DefaultLastErrorCmd}
-	return &FollowersDatabase{
-		userFollowers:        db.C(USER_FOLLOWERS_TABLE),
-		userFollowersCounter: db.C(USER_FOLLOWERS_COUNTERS_TABLE),
-		followPending:        db.C(FOLLOW_PENDING_TABLE),
-		previousUnfollows:    db.C(PREVIOUS_UNFOLLOWS_TABLE),
+	c.conn = conn
+	c.userFollowers = db.C(USER_FOLLOWERS_TABLE)
+	c.userFollowersCounter = db.C(USER_FOLLOWERS_COUNTERS_TABLE)
+	c.followPending = db.C(FOLLOW_PENDING_TABLE)
+	c.previousUnfollows = db.C(PREVIOUS_UNFOLLOWS_TABLE)
+	c.schemaVersion = db.C(SCHEMA_VERSION_TABLE)
+	c.unfollowEvents = db.C(UNFOLLOW_EVENTS_TABLE)
+	c.userSettings = db.C(USER_SETTINGS_TABLE)
+	c.screenNames = db.C(SCREEN_NAMES_TABLE)
+	c.suspectedUnfollows = db.C(SUSPECTED_UNFOLLOWS_TABLE)
+	c.anomalies = db.C(ANOMALIES_TABLE)
+	c.ignoreList = db.C(IGNORE_LIST_TABLE)
+	c.crawlRuns = db.C(CRAWL_RUNS_TABLE)
+	c.crawlProgress = db.C(CRAWL_PROGRESS_TABLE)
+	c.followersPages = db.C(FOLLOWERS_PAGES_TABLE)
+}
+
+// reconnect replaces broken, the connection an operation failed on, with a
+// new one. The retries happen without holding mu, and only one operation
+// reconnects: the others find that broken was already replaced.
+func (c *FollowersDatabase) reconnect(broken mongo.Conn) error {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	c.mu.Lock()
+	replaced := c.conn != broken
+	c.mu.Unlock()
+	if replaced {
+		return nil
+	}
+	conn, err := dialMongoRetrying(c.ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.setConn(conn)
+	return nil
+}
+
+// do runs f, reconnecting and running it again if it fails because the
+// connection is broken. op names the operation in errors. f must be safe to
+// run twice: reads, upserts, removes and $set updates are, inserts aren't.
+func (c *FollowersDatabase) do(op string, f func() error) error {
+	return c.run(op, f, true)
+}
+
+// doOnce is do for operations that can't be repeated, like inserts, which
+// may have reached the server before the connection broke. It reconnects
+// for the next operation, but returns the *ConnectionError without running
+// f again.
+func (c *FollowersDatabase) doOnce(op string, f func() error) error {
+	return c.run(op, f, false)
+}
+
+func (c *FollowersDatabase) run(op string, f func() error, retry bool) error {
+	c.mu.Lock()
+	conn := c.conn
+	err := f()
+	broken := isBrokenConn(conn, err)
+	c.mu.Unlock()
+	if !broken {
+		return err
+	}
+	log.Printf("mongo %v: connection broken (%v), reconnecting", op, err)
+	if rerr := c.reconnect(conn); rerr != nil {
+		if cerr, ok := rerr.(*ConnectionError); ok {
+			cerr.Op = op
+		}
+		return rerr
+	}
+	if !retry {
+		return &ConnectionError{op, 1, err}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = f(); isBrokenConn(c.conn, err) {
+		return &ConnectionError{op, 2, err}
 	}
+	return err
 }
 
 // Insert updates two collections: the user followers table, and the user followers table counters. 
-// The first will be garbage collected later to remove older items. The counters table will be kept forever.
+// The first is garbage collected by CollectSnapshots to remove older items. The counters table will be kept forever.
+// Snapshots are delta encoded, see followersRecord.
 func (c *FollowersDatabase) Insert(uf *userFollowers) (err error) {
 	if dryRunMode {
 		return
 	}
-	err = c.userFollowers.Insert(uf)
+	err = insertFollowersRecord(c, uf)
 	if err != nil {
 		return err
 	}
@@ -83,7 +202,9 @@ func (c *FollowersDatabase) Insert(uf *userFollowers) (err error) {
 		"date":           uf.Date,
 		"followerscount": len(uf.Followers),
 	}
-	return c.userFollowersCounter.Insert(counter)
+	return c.doOnce("insert", func() error {
+		return c.userFollowersCounter.Insert(counter)
+	})
 }
 
 func (c *FollowersDatabase) MarkPendingFollow(uid int64) error {
@@ -91,71 +212,661 @@ func (c *FollowersDatabase) MarkPendingFollow(uid int64) error {
 		"uid":  uid,
 		"date": time.Now().UTC().Unix(),
 	}
-	return c.followPending.Insert(doc)
-}
-
-func (c *FollowersDatabase) Reconnect() {
-	log.Printf("reconnecting, just in case")
-	conn, err := mongo.Dial("127.0.0.1:27017")
-	if err != nil {
-		log.Println("mongo Connect error:", err.Error())
-		panic("mongo conn err")
-	}
-	c.userFollowers.Conn = conn
-	c.userFollowersCounter.Conn = conn
-	c.followPending.Conn = conn
-	c.previousUnfollows.Conn = conn
+	return c.doOnce("insert", func() error {
+		return c.followPending.Insert(doc)
+	})
 }
 
 func (c *FollowersDatabase) GetIsFollowingPending(uid int64) (isPending bool, err error) {
-	cursor, err := c.followPending.Find(map[string]int64{"uid": uid}).Cursor()
-	if err != nil {
-		return false, nil
-	}
-	defer cursor.Close()
-	return cursor.HasNext(), nil
+	err = c.do("find", func() error {
+		isPending, err = c.exists(c.followPending, map[string]int64{"uid": uid})
+		return err
+	})
+	return
 }
 
 func (c *FollowersDatabase) GetWasUnfollowNotified(abandonedUser, unfollower int64) (wasNotified bool) {
 	query := map[string]int64{
 		"uid":        abandonedUser,
 		"unfollower": unfollower,
+		"refollowed": 0,
 	}
-	cursor, err := c.previousUnfollows.Find(query).Cursor()
+	err := c.do("find", func() (err error) {
+		wasNotified, err = c.exists(c.previousUnfollows, query)
+		return err
+	})
 	if err != nil {
-		return false
+		log.Printf("GetWasUnfollowNotified(%d, %d): %v", abandonedUser, unfollower, err)
 	}
-	defer cursor.Close()
-	return cursor.HasNext()
+	return
 }
 
 func (c *FollowersDatabase) MarkUnfollowNotified(abandonedUser, unfollower int64) error {
 	doc := map[string]int64{
 		"uid":        abandonedUser,
 		"unfollower": unfollower,
+		"date":       time.Now().UTC().Unix(),
+		"refollowed": 0,
+	}
+	return c.doOnce("insert", func() error {
+		return c.previousUnfollows.Insert(doc)
+	})
+}
+
+func (c *FollowersDatabase) MarkRefollow(abandonedUser, follower int64) (wasUnfollower bool, err error) {
+	open := map[string]int64{
+		"uid":        abandonedUser,
+		"unfollower": follower,
+		"refollowed": 0,
+	}
+	refollowed := mongo.M{"$set": mongo.M{"refollowed": time.Now().UTC().Unix()}}
+	// Notified unfollows from before the events were recorded are only in
+	// previous_unfollows.
+	// Pointers, since reconnecting replaces the collections.
+	for _, coll := range []*mongo.Collection{&c.unfollowEvents, &c.previousUnfollows} {
+		var found bool
+		err = c.do("find", func() (err error) {
+			found, err = c.exists(*coll, open)
+			return err
+		})
+		if err != nil {
+			return
+		}
+		wasUnfollower = wasUnfollower || found
+		if !found || dryRunMode {
+			continue
+		}
+		err = c.do("update", func() error {
+			return coll.UpdateAll(open, refollowed)
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *FollowersDatabase) RecordUnfollowEvent(e *UnfollowEvent) error {
+	return c.doOnce("insert", func() error {
+		return c.unfollowEvents.Insert(e)
+	})
+}
+
+func (c *FollowersDatabase) UnfollowEventsByUser(uid int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return c.findUnfollowEvents(mongo.M{"uid": uid}, from, to)
+}
+
+func (c *FollowersDatabase) UnfollowEventsByUnfollower(unfollower int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return c.findUnfollowEvents(mongo.M{"unfollower": unfollower}, from, to)
+}
+
+func (c *FollowersDatabase) findUnfollowEvents(query mongo.M, from, to time.Time) (events []*UnfollowEvent, err error) {
+	query["detected"] = mongo.M{"$gte": from.Unix(), "$lt": to.Unix()}
+	err = c.do("find", func() error {
+		events = nil
+		cursor, err := c.unfollowEvents.Find(&mongo.QuerySpec{
+			Query: query,
+			Sort:  mongo.D{{"detected", 1}},
+		}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			e := new(UnfollowEvent)
+			if err = cursor.Next(e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) GetUserSettings(uid int64) (settings *UserSettings, err error) {
+	settings = defaultUserSettings(uid)
+	err = c.do("find", func() error {
+		cursor, err := c.userSettings.Find(mongo.M{"uid": uid}).Limit(1).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		if cursor.HasNext() {
+			return cursor.Next(settings)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) SaveUserSettings(settings *UserSettings) error {
+	return c.do("update", func() error {
+		return c.userSettings.Upsert(mongo.M{"uid": settings.Uid}, settings)
+	})
+}
+
+type screenNameDoc struct {
+	Uid        int64  `bson:"uid"`
+	ScreenName string `bson:"screen_name"`
+	Fetched    int64  `bson:"fetched"`
+}
+
+func (c *FollowersDatabase) GetScreenName(uid int64) (screenName string, fetched int64, err error) {
+	var doc screenNameDoc
+	err = c.do("find", func() error {
+		cursor, err := c.screenNames.Find(mongo.M{"uid": uid}).Limit(1).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		if cursor.HasNext() {
+			return cursor.Next(&doc)
+		}
+		return cursor.Error()
+	})
+	return doc.ScreenName, doc.Fetched, err
+}
+
+func (c *FollowersDatabase) SaveScreenName(uid int64, screenName string, fetched int64) error {
+	return c.do("update", func() error {
+		return c.screenNames.Upsert(mongo.M{"uid": uid}, &screenNameDoc{uid, screenName, fetched})
+	})
+}
+
+func (c *FollowersDatabase) SuspectedUnfollows(uid int64) (suspects []*SuspectedUnfollow, err error) {
+	err = c.do("find", func() error {
+		suspects = nil
+		cursor, err := c.suspectedUnfollows.Find(mongo.M{"uid": uid}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			s := new(SuspectedUnfollow)
+			if err = cursor.Next(s); err != nil {
+				return err
+			}
+			suspects = append(suspects, s)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) SaveSuspectedUnfollow(s *SuspectedUnfollow) error {
+	return c.do("update", func() error {
+		return c.suspectedUnfollows.Upsert(mongo.M{"uid": s.Uid, "unfollower": s.Unfollower}, s)
+	})
+}
+
+func (c *FollowersDatabase) ClearSuspectedUnfollow(uid, unfollower int64) error {
+	return c.do("remove", func() error {
+		return c.suspectedUnfollows.Remove(mongo.M{"uid": uid, "unfollower": unfollower})
+	})
+}
+
+func (c *FollowersDatabase) RecordAnomaly(a *Anomaly) error {
+	return c.doOnce("insert", func() error {
+		return c.anomalies.Insert(a)
+	})
+}
+
+func (c *FollowersDatabase) Anomalies(from, to time.Time) (anomalies []*Anomaly, err error) {
+	err = c.do("find", func() error {
+		anomalies = nil
+		cursor, err := c.anomalies.Find(&mongo.QuerySpec{
+			Query: mongo.M{"detected": mongo.M{"$gte": from.Unix(), "$lt": to.Unix()}},
+			Sort:  mongo.D{{"detected", 1}},
+		}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			a := new(Anomaly)
+			if err = cursor.Next(a); err != nil {
+				return err
+			}
+			anomalies = append(anomalies, a)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) AcknowledgeAnomalies(uid, prevSnapshotDate, at int64) (found bool, err error) {
+	query := mongo.M{"uid": uid, "prevsnapshot": prevSnapshotDate}
+	err = c.do("find", func() (err error) {
+		found, err = c.exists(c.anomalies, query)
+		return err
+	})
+	if err != nil || !found {
+		return
+	}
+	err = c.do("update", func() error {
+		return c.anomalies.UpdateAll(query, mongo.M{"$set": mongo.M{"acknowledged": at}})
+	})
+	return
+}
+
+func (c *FollowersDatabase) AnomalyAcknowledged(uid, prevSnapshotDate int64) (acknowledged bool, err error) {
+	query := mongo.M{"uid": uid, "prevsnapshot": prevSnapshotDate, "acknowledged": mongo.M{"$ne": 0}}
+	err = c.do("find", func() (err error) {
+		acknowledged, err = c.exists(c.anomalies, query)
+		return err
+	})
+	return
+}
+
+func (c *FollowersDatabase) IgnoreList() (entries []*IgnoreEntry, err error) {
+	err = c.do("find", func() error {
+		entries = nil
+		cursor, err := c.ignoreList.Find(nil).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			e := new(IgnoreEntry)
+			if err = cursor.Next(e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) SaveIgnoreEntry(e *IgnoreEntry) error {
+	return c.do("update", func() error {
+		return c.ignoreList.Upsert(mongo.M{"uid": e.Uid, "scope": e.Scope}, e)
+	})
+}
+
+func (c *FollowersDatabase) DeleteIgnoreEntry(e *IgnoreEntry) error {
+	return c.do("remove", func() error {
+		return c.ignoreList.Remove(mongo.M{"uid": e.Uid, "scope": e.Scope})
+	})
+}
+
+func (c *FollowersDatabase) LatestCrawlRun() (run *CrawlRun, err error) {
+	err = c.do("find", func() error {
+		run = nil
+		cursor, err := c.crawlRuns.Find(&mongo.QuerySpec{
+			Query: mongo.M{},
+			Sort:  mongo.D{{"id", -1}},
+		}).Limit(1).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		if cursor.HasNext() {
+			run = new(CrawlRun)
+			return cursor.Next(run)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) SaveCrawlRun(r *CrawlRun) error {
+	return c.do("update", func() error {
+		return c.crawlRuns.Upsert(mongo.M{"id": r.Id}, r)
+	})
+}
+
+type crawlProgressDoc struct {
+	Run int64 `bson:"run"`
+	Uid int64 `bson:"uid"`
+}
+
+func (c *FollowersDatabase) MarkUserCrawled(run, uid int64) error {
+	return c.do("update", func() error {
+		return c.crawlProgress.Upsert(mongo.M{"run": run, "uid": uid}, &crawlProgressDoc{run, uid})
+	})
+}
+
+func (c *FollowersDatabase) CrawledUsers(run int64) (uids []int64, err error) {
+	err = c.do("find", func() error {
+		uids = nil
+		cursor, err := c.crawlProgress.Find(mongo.M{"run": run}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			var doc crawlProgressDoc
+			if err = cursor.Next(&doc); err != nil {
+				return err
+			}
+			uids = append(uids, doc.Uid)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) ClearCrawledUsers(run int64) error {
+	return c.do("remove", func() error {
+		return c.crawlProgress.Remove(mongo.M{"run": mongo.M{"$lt": run}})
+	})
+}
+
+func (c *FollowersDatabase) FollowersPages(uid int64) (pages []*FollowersPage, err error) {
+	err = c.do("find", func() error {
+		pages = nil
+		cursor, err := c.followersPages.Find(&mongo.QuerySpec{
+			Query: mongo.M{"uid": uid},
+			Sort:  mongo.D{{"seq", 1}},
+		}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			p := new(FollowersPage)
+			if err = cursor.Next(p); err != nil {
+				return err
+			}
+			pages = append(pages, p)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+func (c *FollowersDatabase) SaveFollowersPage(p *FollowersPage) error {
+	return c.do("update", func() error {
+		return c.followersPages.Upsert(mongo.M{"uid": p.Uid, "seq": p.Seq}, p)
+	})
+}
+
+func (c *FollowersDatabase) DeleteFollowersPages(uid int64) error {
+	return c.do("remove", func() error {
+		return c.followersPages.Remove(mongo.M{"uid": uid})
+	})
+}
+
+// exists reports whether any document in coll matches query.
+func (c *FollowersDatabase) exists(coll mongo.Collection, query interface{}) (bool, error) {
+	cursor, err := coll.Find(query).Limit(1).Cursor()
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+	if cursor.HasNext() {
+		return true, nil
 	}
-	return c.previousUnfollows.Insert(doc)
+	return false, cursor.Error()
 }
 
 func (c *FollowersDatabase) GetUserFollowers(uid int64) (uf *userFollowers, err error) {
-	cursor, err := c.userFollowers.Find(&mongo.QuerySpec{
+	uf, err = getUserFollowersFromRecords(c, uid)
+	if err != nil || uf == nil {
+		return
+	}
+	if uf.Followers == nil {
+		log.Println("uf.Followers is nil. Incorrect database schema or bson decoding?")
+	}
+	return
+}
+
+func (c *FollowersDatabase) latestChain(uid int64) (base *followersRecord, deltas []*followersRecord, err error) {
+	latest, err := c.findRecords(&mongo.QuerySpec{
 		Query: mongo.M{"uid": uid},
-		Sort:  mongo.D{{"date", -1}},
-	}).Cursor()
+		// On ties, the last one inserted wins.
+		Sort: mongo.D{{"date", -1}, {"_id", -1}},
+	}, 1)
+	if err != nil || len(latest) == 0 {
+		return
+	}
+	if !latest[0].Delta {
+		return latest[0], nil, nil
+	}
+	last := latest[0]
+	bases, err := c.findRecords(mongo.M{"uid": uid, "date": last.Base, "delta": mongo.M{"$ne": true}}, 1)
 	if err != nil {
 		return
 	}
-	defer cursor.Close()
-
-	if !cursor.HasNext() {
+	if len(bases) == 0 {
+		return nil, nil, fmt.Errorf("missing full snapshot %d for uid %d", last.Base, uid)
+	}
+	deltas, err = c.findRecords(&mongo.QuerySpec{
+		Query: mongo.M{"uid": uid, "delta": true, "base": last.Base, "date": mongo.M{"$lte": last.Date}},
+		Sort:  mongo.D{{"date", 1}},
+	}, 0)
+	if err != nil {
 		return
 	}
-	err = cursor.Next(&uf)
+	return bases[0], deltas, nil
+}
 
-	if uf == nil {
-		log.Println("uf object remained nil. Bug in go-mongo?")
-	} else if uf.Followers == nil {
-		log.Println("uf.Followers is nil. Incorrect database schema or bson decoding?")
+func (c *FollowersDatabase) insertRecord(r *followersRecord) error {
+	return c.doOnce("insert", func() error {
+		return c.userFollowers.Insert(r)
+	})
+}
+
+// findRecords returns up to limit user_followers records matching query, or
+// all of them if limit is 0.
+func (c *FollowersDatabase) findRecords(query interface{}, limit int) (records []*followersRecord, err error) {
+	err = c.do("find", func() error {
+		records = nil
+		cursor, err := c.userFollowers.Find(query).Limit(limit).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			var r followersRecord
+			if err = cursor.Next(&r); err != nil {
+				return err
+			}
+			records = append(records, &r)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+// CollectSnapshots removes old user_followers records. Only the fields
+// needed to pick them are read, and one user is handled at a time.
+func (c *FollowersDatabase) CollectSnapshots(p RetentionPolicy, now time.Time) (removed int, err error) {
+	var uids []int64
+	err = c.do("distinct", func() error {
+		var res struct {
+			Values []int64 `bson:"values"`
+		}
+		db := mongo.Database{c.conn, DbName, mongo.DefaultLastErrorCmd}
+		err := db.Run(mongo.D{{"distinct", USER_FOLLOWERS_TABLE}, {"key", "uid"}}, &res)
+		uids = res.Values
+		return err
+	})
+	if err != nil {
+		return
+	}
+	for _, uid := range uids {
+		records, err := c.recordHeaders(uid)
+		if err != nil {
+			return removed, err
+		}
+		for _, r := range unretainedRecords(records, p, now) {
+			removed++
+			if dryRunMode {
+				continue
+			}
+			selector := mongo.M{"_id": r.Id}
+			if err := c.do("remove", func() error { return c.userFollowers.Remove(selector) }); err != nil {
+				return removed, err
+			}
+		}
 	}
 	return
 }
+
+// recordHeaders returns the user_followers records of uid in the order they
+// were inserted, without their lists of followers.
+func (c *FollowersDatabase) recordHeaders(uid int64) (records []*followersRecord, err error) {
+	err = c.do("find", func() error {
+		records = nil
+		cursor, err := c.userFollowers.Find(&mongo.QuerySpec{
+			Query: mongo.M{"uid": uid},
+			Sort:  mongo.D{{"_id", 1}},
+		}).Fields(mongo.M{"_id": 1, "uid": 1, "date": 1, "delta": 1, "base": 1}).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for cursor.HasNext() {
+			r := new(followersRecord)
+			if err = cursor.Next(r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return cursor.Error()
+	})
+	return
+}
+
+// The schema version is kept in a single document.
+var schemaVersionId = mongo.M{"_id": "schema"}
+
+func (c *FollowersDatabase) getSchemaVersion() (version int, err error) {
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	var found bool
+	err = c.do("find", func() error {
+		cursor, err := c.schemaVersion.Find(schemaVersionId).Cursor()
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		if found = cursor.HasNext(); found {
+			return cursor.Next(&doc)
+		}
+		return cursor.Error()
+	})
+	if err != nil || found {
+		return doc.Version, err
+	}
+	// No version marker. Tell an empty database from an old one.
+	for _, name := range []string{USER_FOLLOWERS_TABLE, PREVIOUS_UNFOLLOWS_TABLE, FOLLOW_PENDING_TABLE, UNFOLLOW_EVENTS_TABLE} {
+		var hasData bool
+		err = c.do("find", func() (err error) {
+			db := mongo.Database{c.conn, DbName, mongo.DefaultLastErrorCmd}
+			hasData, err = c.exists(db.C(name), mongo.M{})
+			return err
+		})
+		if err != nil || hasData {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+func (c *FollowersDatabase) setSchemaVersion(version int) error {
+	return c.do("update", func() error {
+		return c.schemaVersion.Upsert(schemaVersionId, mongo.M{"_id": "schema", "version": version})
+	})
+}
+
+func (c *FollowersDatabase) migrateTo(version int) error {
+	switch version {
+	case 2:
+		return c.do("update", func() error {
+			return c.previousUnfollows.UpdateAll(
+				mongo.M{"date": mongo.M{"$exists": false}},
+				mongo.M{"$set": mongo.M{"date": 0}})
+		})
+	case 3:
+		err := c.do("update", func() error {
+			return c.previousUnfollows.UpdateAll(
+				mongo.M{"refollowed": mongo.M{"$exists": false}},
+				mongo.M{"$set": mongo.M{"refollowed": 0}})
+		})
+		if err != nil {
+			return err
+		}
+		// Replaced by the one including refollowed.
+		err = c.do("dropIndexes", func() error {
+			db := mongo.Database{c.conn, DbName, mongo.DefaultLastErrorCmd}
+			var res mongo.M
+			return db.Run(mongo.D{{"dropIndexes", PREVIOUS_UNFOLLOWS_TABLE}, {"index", "uid_1_unfollower_1"}}, &res)
+		})
+		if err != nil && strings.Contains(err.Error(), "not found") {
+			err = nil
+		}
+		return err
+	case 4:
+		return c.do("update", func() error {
+			return c.unfollowEvents.UpdateAll(
+				mongo.M{"reason": mongo.M{"$exists": false}},
+				mongo.M{"$set": mongo.M{"reason": ReasonUnfollowed}})
+		})
+	case 5:
+		return c.do("update", func() error {
+			return c.anomalies.UpdateAll(
+				mongo.M{"acknowledged": mongo.M{"$exists": false}},
+				mongo.M{"$set": mongo.M{"acknowledged": 0}})
+		})
+	case 6:
+		return c.do("update", func() error {
+			return c.unfollowEvents.UpdateAll(
+				mongo.M{"refollowed": mongo.M{"$exists": false}},
+				mongo.M{"$set": mongo.M{"refollowed": 0}})
+		})
+	}
+	return fmt.Errorf("no migration to version %d", version)
+}
+
+func (c *FollowersDatabase) ensureIndex(ix indexSpec) (created bool, err error) {
+	// Not system.indexes, which newer servers don't have.
+	var exists bool
+	err = c.do("listIndexes", func() error {
+		var res struct {
+			Cursor struct {
+				FirstBatch []struct {
+					Name string `bson:"name"`
+				} `bson:"firstBatch"`
+			} `bson:"cursor"`
+		}
+		db := mongo.Database{c.conn, DbName, mongo.DefaultLastErrorCmd}
+		err := db.Run(mongo.D{{"listIndexes", ix.Table}}, &res)
+		if err != nil && strings.Contains(err.Error(), "ns does not exist") {
+			// No collection yet, so no indexes.
+			return nil
+		}
+		for _, i := range res.Cursor.FirstBatch {
+			exists = exists || i.Name == ix.name()
+		}
+		return err
+	})
+	if err != nil || exists {
+		return false, err
+	}
+	if dryRunMode {
+		return true, nil
+	}
+	keys := make(mongo.D, 0, len(ix.Keys))
+	for _, k := range ix.Keys {
+		keys = append(keys, mongo.DocItem{k.Field, k.Order})
+	}
+	err = c.do("createIndexes", func() error {
+		db := mongo.Database{c.conn, DbName, mongo.DefaultLastErrorCmd}
+		var res mongo.M
+		return db.Run(mongo.D{
+			{"createIndexes", ix.Table},
+			{"indexes", []mongo.D{{
+				{"key", keys},
+				{"name", ix.name()},
+				{"unique", ix.Unique},
+				{"background", true},
+			}}},
+		}, &res)
+	})
+	return err == nil, err
+}
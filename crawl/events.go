@@ -0,0 +1,78 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"time"
+)
+
+// Notification status of an UnfollowEvent.
+const (
+	// The user was told about the unfollow.
+	UnfollowNotified = "notified"
+	// Sending the notification failed.
+	UnfollowNotifyFailed = "failed"
+	// Notifications were disabled with -notifyUsers=false.
+	UnfollowNotNotified = "not_notified"
+	// The user had already been told about this unfollow.
+	UnfollowAlreadyNotified = "already_notified"
+	// The unfollower's account is gone and -notifyDeparted is off.
+	UnfollowSuppressed = "suppressed"
+)
+
+// Why a follower went missing, see UnfollowEvent.Reason.
+const (
+	// They stopped following.
+	ReasonUnfollowed = "unfollowed"
+	// Their account was suspended by twitter.
+	ReasonSuspended = "suspended"
+	// Their account was deactivated or deleted.
+	ReasonDeactivated = "deactivated"
+	// Twitter doesn't know about them anymore, for some other reason.
+	ReasonNotFound = "not_found"
+)
+
+// UnfollowEvent records an unfollow found by the crawler.
+type UnfollowEvent struct {
+	// Uid is the abandoned user.
+	Uid        int64 `bson:"uid"`
+	Unfollower int64 `bson:"unfollower"`
+	// DetectedAt is when the crawler found the unfollow, in seconds since
+	// the epoch like the snapshot dates.
+	DetectedAt int64 `bson:"detected"`
+	// Dates of the snapshots in which the unfollower was last seen, and
+	// first missing.
+	PrevSnapshotDate int64  `bson:"prevsnapshot"`
+	NewSnapshotDate  int64  `bson:"newsnapshot"`
+	Reason           string `bson:"reason"`
+	Status           string `bson:"status"`
+	// Refollowed is when Unfollower was found following Uid again, or 0.
+	Refollowed int64 `bson:"refollowed"`
+}
+
+func (e *UnfollowEvent) String() string {
+	return fmt.Sprintf("%v: %d left %d, %v (between snapshots of %v and %v), %v",
+		time.Unix(e.DetectedAt, 0).UTC().Format(time.RFC3339), e.Unfollower, e.Uid, e.Reason,
+		time.Unix(e.PrevSnapshotDate, 0).UTC().Format(time.RFC3339),
+		time.Unix(e.NewSnapshotDate, 0).UTC().Format(time.RFC3339), e.Status)
+}
+
+// eventsByDate sorts events by the time they were detected.
+type eventsByDate []*UnfollowEvent
+
+func (e eventsByDate) Len() int           { return len(e) }
+func (e eventsByDate) Less(i, j int) bool { return e[i].DetectedAt < e[j].DetectedAt }
+func (e eventsByDate) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,111 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"time"
+)
+
+var maxPartialAge time.Duration
+
+func init() {
+	flag.DurationVar(&maxPartialAge, "maxPartialAge", 24*time.Hour,
+		"Pages of a follower list that couldn't be fetched completely are kept this long, to be continued by a later crawl.")
+}
+
+// FollowersPage is one page of followers/ids, saved until the whole list of
+// followers of Uid has been fetched.
+type FollowersPage struct {
+	Uid int64 `bson:"uid"`
+	// Seq is the position of the page in the list, starting at 0.
+	Seq int `bson:"seq"`
+	// Started is when the first page was fetched.
+	Started    int64   `bson:"started"`
+	Cursor     int64   `bson:"cursor"`
+	NextCursor int64   `bson:"next_cursor"`
+	Ids        []int64 `bson:"ids"`
+}
+
+// fetchFollowers gets all the followers of uid from twitter. Each page is
+// saved as soon as it's fetched, so if one fails, e.g. because the crawl is
+// interrupted while waiting for the rate limit, the next attempt continues
+// from there instead of starting over. paged tells whether there are saved
+// pages, which the caller deletes with deleteFollowersPages once uf is
+// committed.
+func (c *FollowersCrawler) fetchFollowers(ctx context.Context, uid int64) (uf *userFollowers, paged bool, err error) {
+	pages, err := c.db.FollowersPages(uid)
+	if err != nil {
+		log.Printf("FollowersPages(%d): %v", uid, err)
+		pages = nil
+	}
+	if len(pages) > 0 && time.Since(time.Unix(pages[0].Started, 0)) > maxPartialAge {
+		log.Printf("Discarding the %d followers pages of %d from %v", len(pages), uid, time.Unix(pages[0].Started, 0))
+		c.deleteFollowersPages(uid)
+		pages = nil
+	}
+	var (
+		started = time.Now().UTC().Unix()
+		cursor  = int64(-1)
+	)
+	if len(pages) > 0 {
+		last := pages[len(pages)-1]
+		started, cursor = pages[0].Started, last.NextCursor
+		log.Printf("Continuing the followers of %d from page %d", uid, last.Seq+1)
+	}
+	for cursor != 0 {
+		ids, next, err := c.tw.getFollowersPage(ctx, uid, cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(pages) == 0 && len(ids) == 0 {
+			return nil, false, errors.New("no followers.")
+		}
+		p := &FollowersPage{uid, len(pages), started, cursor, next, ids}
+		pages = append(pages, p)
+		cursor = next
+		if dryRunMode || next == 0 {
+			continue
+		}
+		if err := c.db.SaveFollowersPage(p); err != nil {
+			log.Printf("SaveFollowersPage(%d, %d): %v", uid, p.Seq, err)
+		}
+	}
+	// Pages fetched at different times may overlap.
+	seen := map[int64]bool{}
+	var followers []int64
+	for _, p := range pages {
+		for _, id := range p.Ids {
+			if !seen[id] {
+				seen[id] = true
+				followers = append(followers, id)
+			}
+		}
+	}
+	// The last page is never saved.
+	return &userFollowers{uid, time.Now().UTC().Unix(), followers}, len(pages) > 1, nil
+}
+
+func (c *FollowersCrawler) deleteFollowersPages(uid int64) {
+	if dryRunMode {
+		return
+	}
+	if err := c.db.DeleteFollowersPages(uid); err != nil {
+		log.Printf("DeleteFollowersPages(%d): %v", uid, err)
+	}
+}
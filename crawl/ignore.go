@@ -0,0 +1,119 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Scopes of an IgnoreEntry.
+const (
+	// Don't look for unfollows of this user.
+	IgnoreWatched = "watched"
+	// Don't report this user following or unfollowing anyone, e.g.
+	// because twitter keeps dropping them from follower lists.
+	IgnoreUnfollower = "unfollower"
+)
+
+// IgnoreEntry is a user that the crawler ignores in Scope.
+type IgnoreEntry struct {
+	Uid   int64  `bson:"uid"`
+	Scope string `bson:"scope"`
+}
+
+// ignoreList has the ignored uids by scope.
+type ignoreList struct {
+	watched    map[int64]bool
+	unfollower map[int64]bool
+}
+
+// newIgnoreList returns the list given by the -ignoreUsers flag. The uids
+// in it are ignored in both scopes.
+func newIgnoreList() *ignoreList {
+	l := &ignoreList{watched: map[int64]bool{}, unfollower: map[int64]bool{}}
+	for _, s := range strings.Split(ignoredUsers, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		uid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.Printf("-ignoreUsers: bad uid %q: %v", s, err)
+			continue
+		}
+		l.watched[uid] = true
+		l.unfollower[uid] = true
+	}
+	return l
+}
+
+func (l *ignoreList) add(e *IgnoreEntry) {
+	switch e.Scope {
+	case IgnoreWatched:
+		l.watched[e.Uid] = true
+	case IgnoreUnfollower:
+		l.unfollower[e.Uid] = true
+	}
+}
+
+func checkIgnoreScope(scope string) error {
+	switch scope {
+	case IgnoreWatched, IgnoreUnfollower:
+		return nil
+	}
+	return fmt.Errorf("unknown ignore scope %q, want %v or %v", scope, IgnoreWatched, IgnoreUnfollower)
+}
+
+// AddIgnore makes the crawler ignore uid in scope, one of the Ignore*
+// constants.
+func AddIgnore(db FollowersStore, uid int64, scope string) error {
+	if err := checkIgnoreScope(scope); err != nil {
+		return err
+	}
+	if dryRunMode {
+		log.Printf("dryRunMode, not ignoring %d as %v", uid, scope)
+		return nil
+	}
+	return db.SaveIgnoreEntry(&IgnoreEntry{uid, scope})
+}
+
+// RemoveIgnore undoes AddIgnore.
+func RemoveIgnore(db FollowersStore, uid int64, scope string) error {
+	if err := checkIgnoreScope(scope); err != nil {
+		return err
+	}
+	if dryRunMode {
+		log.Printf("dryRunMode, not removing %d from the %v ignore list", uid, scope)
+		return nil
+	}
+	return db.DeleteIgnoreEntry(&IgnoreEntry{uid, scope})
+}
+
+// loadIgnoreList reads the ignore list from the database, on top of the
+// -ignoreUsers flag.
+func (c *FollowersCrawler) loadIgnoreList() error {
+	entries, err := c.db.IgnoreList()
+	if err != nil {
+		return err
+	}
+	l := newIgnoreList()
+	for _, e := range entries {
+		l.add(e)
+	}
+	c.ignored = l
+	return nil
+}
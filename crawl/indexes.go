@@ -0,0 +1,109 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type indexKey struct {
+	Field string
+	// Order is 1 for ascending, -1 for descending.
+	Order int
+}
+
+// indexSpec describes an index that the stores make sure exists at startup.
+type indexSpec struct {
+	Table  string
+	Keys   []indexKey
+	Unique bool
+}
+
+// name follows mongo's naming convention, e.g. "uid_1_date_-1".
+func (ix indexSpec) name() string {
+	parts := make([]string, 0, 2*len(ix.Keys))
+	for _, k := range ix.Keys {
+		parts = append(parts, k.Field, fmt.Sprint(k.Order))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (ix indexSpec) String() string {
+	s := ix.Table + "." + ix.name()
+	if ix.Unique {
+		s += " (unique)"
+	}
+	return s
+}
+
+// followersIndexes covers the queries done by the stores.
+var followersIndexes = []indexSpec{
+	// GetUserFollowers: the latest record of a user.
+	{Table: USER_FOLLOWERS_TABLE, Keys: []indexKey{{"uid", 1}, {"date", -1}}},
+	// GetUserFollowers: the deltas of a chain.
+	{Table: USER_FOLLOWERS_TABLE, Keys: []indexKey{{"uid", 1}, {"base", 1}, {"date", 1}}},
+	{Table: USER_FOLLOWERS_COUNTERS_TABLE, Keys: []indexKey{{"uid", 1}, {"date", 1}}},
+	{Table: FOLLOW_PENDING_TABLE, Keys: []indexKey{{"uid", 1}}},
+	// A user is notified only once of each unfollow: there can't be two
+	// open follow episodes (refollowed = 0) for a pair.
+	{Table: PREVIOUS_UNFOLLOWS_TABLE, Keys: []indexKey{{"uid", 1}, {"unfollower", 1}, {"refollowed", 1}}, Unique: true},
+	{Table: UNFOLLOW_EVENTS_TABLE, Keys: []indexKey{{"uid", 1}, {"detected", 1}}},
+	{Table: UNFOLLOW_EVENTS_TABLE, Keys: []indexKey{{"unfollower", 1}, {"detected", 1}}},
+	// MarkRefollow.
+	{Table: UNFOLLOW_EVENTS_TABLE, Keys: []indexKey{{"uid", 1}, {"unfollower", 1}, {"refollowed", 1}}},
+	{Table: USER_SETTINGS_TABLE, Keys: []indexKey{{"uid", 1}}, Unique: true},
+	{Table: SCREEN_NAMES_TABLE, Keys: []indexKey{{"uid", 1}}, Unique: true},
+	{Table: SUSPECTED_UNFOLLOWS_TABLE, Keys: []indexKey{{"uid", 1}, {"unfollower", 1}}, Unique: true},
+	{Table: ANOMALIES_TABLE, Keys: []indexKey{{"detected", 1}}},
+	// AnomalyAcknowledged.
+	{Table: ANOMALIES_TABLE, Keys: []indexKey{{"uid", 1}, {"prevsnapshot", 1}}},
+	{Table: IGNORE_LIST_TABLE, Keys: []indexKey{{"uid", 1}, {"scope", 1}}, Unique: true},
+	{Table: CRAWL_RUNS_TABLE, Keys: []indexKey{{"id", 1}}, Unique: true},
+	{Table: CRAWL_PROGRESS_TABLE, Keys: []indexKey{{"run", 1}, {"uid", 1}}, Unique: true},
+	{Table: FOLLOWERS_PAGES_TABLE, Keys: []indexKey{{"uid", 1}, {"seq", 1}}, Unique: true},
+}
+
+// indexEnsurer is implemented by the stores that need indexes.
+type indexEnsurer interface {
+	// ensureIndex creates ix if it doesn't exist yet, and reports whether
+	// it did.
+	ensureIndex(ix indexSpec) (created bool, err error)
+}
+
+// ensureIndexes creates the missing followersIndexes and logs what it did.
+// A failure, e.g. a unique index over existing duplicates, is logged and
+// doesn't stop the others from being created.
+func ensureIndexes(db indexEnsurer) (created []indexSpec) {
+	for _, ix := range followersIndexes {
+		ok, err := db.ensureIndex(ix)
+		if err != nil {
+			log.Printf("Could not create index %v: %v", ix, err)
+			continue
+		}
+		if ok {
+			created = append(created, ix)
+		}
+	}
+	for _, ix := range created {
+		if dryRunMode {
+			log.Printf("dryRunMode, missing index %v", ix)
+		} else {
+			log.Printf("Created index %v", ix)
+		}
+	}
+	return
+}
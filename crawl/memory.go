@@ -0,0 +1,405 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type unfollowKey struct {
+	abandonedUser, unfollower int64
+}
+
+// MemoryDatabase is a FollowersStore that lives only as long as the process.
+// It's used by tests and for trying out the crawler without a database.
+type MemoryDatabase struct {
+	mu            sync.Mutex
+	records       map[int64][]*followersRecord
+	counters      []map[string]interface{}
+	followPending map[int64]int64
+	// unfollows has the pairs with a notified unfollow in the current
+	// follow episode.
+	unfollows map[unfollowKey]bool
+	events    []*UnfollowEvent
+	settings  map[int64]UserSettings
+	names     map[int64]screenNameDoc
+	suspects  map[unfollowKey]SuspectedUnfollow
+	anomalies []*Anomaly
+	ignore    map[IgnoreEntry]bool
+	runs      map[int64]CrawlRun
+	// progress has the users done in each run.
+	progress map[int64]map[int64]bool
+	pages    map[int64][]*FollowersPage
+}
+
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		records:       map[int64][]*followersRecord{},
+		followPending: map[int64]int64{},
+		unfollows:     map[unfollowKey]bool{},
+		settings:      map[int64]UserSettings{},
+		names:         map[int64]screenNameDoc{},
+		suspects:      map[unfollowKey]SuspectedUnfollow{},
+		ignore:        map[IgnoreEntry]bool{},
+		runs:          map[int64]CrawlRun{},
+		progress:      map[int64]map[int64]bool{},
+		pages:         map[int64][]*FollowersPage{},
+	}
+}
+
+func (m *MemoryDatabase) Insert(uf *userFollowers) (err error) {
+	if dryRunMode {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err = insertFollowersRecord(m, uf); err != nil {
+		return err
+	}
+	m.counters = append(m.counters, map[string]interface{}{
+		"uid":            uf.Uid,
+		"date":           uf.Date,
+		"followerscount": len(uf.Followers),
+	})
+	return
+}
+
+// GetUserFollowers returns the snapshot with the latest date, which isn't
+// necessarily the last one inserted.
+func (m *MemoryDatabase) GetUserFollowers(uid int64) (uf *userFollowers, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return getUserFollowersFromRecords(m, uid)
+}
+
+// latestChain and insertRecord must be called with m.mu held.
+func (m *MemoryDatabase) latestChain(uid int64) (base *followersRecord, deltas []*followersRecord, err error) {
+	return latestChainOf(m.records[uid])
+}
+
+func (m *MemoryDatabase) insertRecord(r *followersRecord) error {
+	// Keep a copy so callers can't change what was saved.
+	saved := *r
+	saved.Followers = append([]int64(nil), r.Followers...)
+	m.records[r.Uid] = append(m.records[r.Uid], &saved)
+	return nil
+}
+
+func (m *MemoryDatabase) MarkPendingFollow(uid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.followPending[uid] = time.Now().UTC().Unix()
+	return nil
+}
+
+func (m *MemoryDatabase) GetIsFollowingPending(uid int64) (isPending bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, isPending = m.followPending[uid]
+	return
+}
+
+func (m *MemoryDatabase) GetWasUnfollowNotified(abandonedUser, unfollower int64) (wasNotified bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unfollows[unfollowKey{abandonedUser, unfollower}]
+}
+
+func (m *MemoryDatabase) MarkUnfollowNotified(abandonedUser, unfollower int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unfollows[unfollowKey{abandonedUser, unfollower}] = true
+	return nil
+}
+
+func (m *MemoryDatabase) MarkRefollow(abandonedUser, follower int64) (wasUnfollower bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC().Unix()
+	for _, e := range m.events {
+		if e.Uid == abandonedUser && e.Unfollower == follower && e.Refollowed == 0 {
+			wasUnfollower = true
+			if !dryRunMode {
+				e.Refollowed = now
+			}
+		}
+	}
+	key := unfollowKey{abandonedUser, follower}
+	wasUnfollower = wasUnfollower || m.unfollows[key]
+	if !dryRunMode {
+		delete(m.unfollows, key)
+	}
+	return
+}
+
+func (m *MemoryDatabase) CollectSnapshots(p RetentionPolicy, now time.Time) (removed int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uid, records := range m.records {
+		drop := unretainedRecords(records, p, now)
+		removed += len(drop)
+		if dryRunMode || len(drop) == 0 {
+			continue
+		}
+		dropped := map[*followersRecord]bool{}
+		for _, r := range drop {
+			dropped[r] = true
+		}
+		kept := records[:0]
+		for _, r := range records {
+			if !dropped[r] {
+				kept = append(kept, r)
+			}
+		}
+		m.records[uid] = kept
+	}
+	return
+}
+
+func (m *MemoryDatabase) RecordUnfollowEvent(e *UnfollowEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *e
+	m.events = append(m.events, &saved)
+	return nil
+}
+
+func (m *MemoryDatabase) UnfollowEventsByUser(uid int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return m.findUnfollowEvents(func(e *UnfollowEvent) bool { return e.Uid == uid }, from, to), nil
+}
+
+func (m *MemoryDatabase) UnfollowEventsByUnfollower(unfollower int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return m.findUnfollowEvents(func(e *UnfollowEvent) bool { return e.Unfollower == unfollower }, from, to), nil
+}
+
+func (m *MemoryDatabase) findUnfollowEvents(match func(*UnfollowEvent) bool, from, to time.Time) (events []*UnfollowEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.events {
+		if match(e) && e.DetectedAt >= from.Unix() && e.DetectedAt < to.Unix() {
+			found := *e
+			events = append(events, &found)
+		}
+	}
+	sort.Sort(eventsByDate(events))
+	return
+}
+
+func (m *MemoryDatabase) GetUserSettings(uid int64) (*UserSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.settings[uid]; ok {
+		return &s, nil
+	}
+	return defaultUserSettings(uid), nil
+}
+
+func (m *MemoryDatabase) SaveUserSettings(s *UserSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[s.Uid] = *s
+	return nil
+}
+
+func (m *MemoryDatabase) GetScreenName(uid int64) (screenName string, fetched int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc := m.names[uid]
+	return doc.ScreenName, doc.Fetched, nil
+}
+
+func (m *MemoryDatabase) SaveScreenName(uid int64, screenName string, fetched int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names[uid] = screenNameDoc{uid, screenName, fetched}
+	return nil
+}
+
+func (m *MemoryDatabase) SuspectedUnfollows(uid int64) (suspects []*SuspectedUnfollow, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, s := range m.suspects {
+		if k.abandonedUser == uid {
+			found := s
+			suspects = append(suspects, &found)
+		}
+	}
+	return
+}
+
+func (m *MemoryDatabase) SaveSuspectedUnfollow(s *SuspectedUnfollow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.suspects[unfollowKey{s.Uid, s.Unfollower}] = *s
+	return nil
+}
+
+func (m *MemoryDatabase) ClearSuspectedUnfollow(uid, unfollower int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.suspects, unfollowKey{uid, unfollower})
+	return nil
+}
+
+func (m *MemoryDatabase) RecordAnomaly(a *Anomaly) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *a
+	m.anomalies = append(m.anomalies, &saved)
+	return nil
+}
+
+func (m *MemoryDatabase) Anomalies(from, to time.Time) (anomalies []*Anomaly, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.anomalies {
+		if a.DetectedAt >= from.Unix() && a.DetectedAt < to.Unix() {
+			found := *a
+			anomalies = append(anomalies, &found)
+		}
+	}
+	sort.Sort(anomaliesByDate(anomalies))
+	return
+}
+
+func (m *MemoryDatabase) AcknowledgeAnomalies(uid, prevSnapshotDate, at int64) (found bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.anomalies {
+		if a.Uid == uid && a.PrevSnapshotDate == prevSnapshotDate {
+			a.Acknowledged = at
+			found = true
+		}
+	}
+	return
+}
+
+func (m *MemoryDatabase) AnomalyAcknowledged(uid, prevSnapshotDate int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.anomalies {
+		if a.Uid == uid && a.PrevSnapshotDate == prevSnapshotDate && a.Acknowledged != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryDatabase) IgnoreList() (entries []*IgnoreEntry, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for e := range m.ignore {
+		found := e
+		entries = append(entries, &found)
+	}
+	return
+}
+
+func (m *MemoryDatabase) SaveIgnoreEntry(e *IgnoreEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ignore[*e] = true
+	return nil
+}
+
+func (m *MemoryDatabase) DeleteIgnoreEntry(e *IgnoreEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ignore, *e)
+	return nil
+}
+
+func (m *MemoryDatabase) LatestCrawlRun() (*CrawlRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest *CrawlRun
+	for _, r := range m.runs {
+		if latest == nil || r.Id > latest.Id {
+			found := r
+			latest = &found
+		}
+	}
+	return latest, nil
+}
+
+func (m *MemoryDatabase) SaveCrawlRun(r *CrawlRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[r.Id] = *r
+	return nil
+}
+
+func (m *MemoryDatabase) MarkUserCrawled(run, uid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.progress[run] == nil {
+		m.progress[run] = map[int64]bool{}
+	}
+	m.progress[run][uid] = true
+	return nil
+}
+
+func (m *MemoryDatabase) CrawledUsers(run int64) (uids []int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uid := range m.progress[run] {
+		uids = append(uids, uid)
+	}
+	return
+}
+
+func (m *MemoryDatabase) ClearCrawledUsers(run int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for r := range m.progress {
+		if r < run {
+			delete(m.progress, r)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDatabase) FollowersPages(uid int64) (pages []*FollowersPage, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pages[uid] {
+		found := *p
+		pages = append(pages, &found)
+	}
+	return
+}
+
+func (m *MemoryDatabase) SaveFollowersPage(p *FollowersPage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *p
+	saved.Ids = append([]int64(nil), p.Ids...)
+	pages := m.pages[p.Uid]
+	for len(pages) <= p.Seq {
+		pages = append(pages, nil)
+	}
+	pages[p.Seq] = &saved
+	m.pages[p.Uid] = pages
+	return nil
+}
+
+func (m *MemoryDatabase) DeleteFollowersPages(uid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pages, uid)
+	return nil
+}
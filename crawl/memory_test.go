@@ -0,0 +1,52 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryMissingUser(t *testing.T) {
+	m := NewMemoryDatabase()
+	u, err := m.GetUserFollowers(testMissingUser)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if u != nil {
+		t.Error("GetUserFollower(testMissingUser) returned unexpected result")
+	}
+}
+
+func TestMemoryLatestSnapshot(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	m := NewMemoryDatabase()
+	newer := &userFollowers{testExistingUser, 200, []int64{1000, 3000}}
+	older := &userFollowers{testExistingUser, 100, []int64{1000, 2000, 3000}}
+	for _, uf := range []*userFollowers{newer, older} {
+		if err := m.Insert(uf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := m.GetUserFollowers(testExistingUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, newer) {
+		t.Errorf("expected\n%v\ngot\n%v", newer, u)
+	}
+}
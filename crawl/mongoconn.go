@@ -0,0 +1,120 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/garyburd/go-mongo/mongo"
+)
+
+var (
+	mongoRetries    int
+	mongoMaxBackoff time.Duration
+)
+
+func init() {
+	flag.IntVar(&mongoRetries, "mongoRetries", 6,
+		"Number of times to retry connecting to mongo before giving up on an operation.")
+	flag.DurationVar(&mongoMaxBackoff, "mongoMaxBackoff", 30*time.Second,
+		"Maximum wait between mongo connection attempts.")
+}
+
+const mongoMinBackoff = 500 * time.Millisecond
+
+// ConnectionError is returned by FollowersDatabase when the mongo server
+// can't be reached, even after retrying, or when the connection broke during
+// an insert, which isn't retried.
+type ConnectionError struct {
+	// Op is the operation that failed, e.g. "dial" or "insert".
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("mongo %v: giving up after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// backoff returns how long to wait before the given retry attempt, counting
+// from 1.
+func backoff(attempt int) time.Duration {
+	d := mongoMinBackoff
+	for i := 1; i < attempt && d < mongoMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > mongoMaxBackoff {
+		d = mongoMaxBackoff
+	}
+	return d
+}
+
+// dialMongoRetrying connects to the server set by -mongoURI, retrying with
+// exponential backoff until ctx is done.
+func dialMongoRetrying(ctx context.Context) (conn mongo.Conn, err error) {
+	u, err := parseMongoURI(mongoURIFlag)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		if conn, err = dialMongo(u); err == nil {
+			break
+		}
+		if attempt > mongoRetries {
+			return nil, &ConnectionError{"dial", attempt, err}
+		}
+		wait := backoff(attempt)
+		log.Printf("mongo connect error: %v. Retrying in %v", err, wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, &ConnectionError{"dial", attempt, ctx.Err()}
+		}
+	}
+	if verboseMongo {
+		conn = mongo.NewLoggingConn(conn, log.New(os.Stderr, "", 0), "")
+	}
+	return conn, nil
+}
+
+// isBrokenConn tells whether err, returned by an operation on conn, means
+// the connection is no longer usable. Other errors, like a duplicate key,
+// are returned to the caller as they are.
+func isBrokenConn(conn mongo.Conn, err error) bool {
+	if err == nil {
+		return false
+	}
+	if conn == nil || conn.Error() != nil {
+		return true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,225 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/go-mongo/mongo"
+)
+
+const defaultMongoURI = "mongodb://127.0.0.1:27017"
+
+var mongoURIFlag string
+
+func init() {
+	uri := os.Getenv("JAVAITARDE_MONGO_URI")
+	if uri == "" {
+		uri = defaultMongoURI
+	}
+	flag.StringVar(&mongoURIFlag, "mongoURI", uri,
+		"MongoDB connection string: mongodb://[user:password@]host1[:port1][,host2...][/authdb][?options]. "+
+			"Supported options: authSource, replicaSet, connectTimeoutMS; others are rejected. Defaults to $JAVAITARDE_MONGO_URI.")
+}
+
+// mongoURI holds the connection settings from a mongodb:// connection string.
+type mongoURI struct {
+	Hosts    []string
+	Username string
+	Password string
+	// AuthSource is the database holding the user's credentials.
+	AuthSource string
+	// ReplicaSet, if set, makes the dialer look for the primary of the
+	// named replica set among Hosts.
+	ReplicaSet     string
+	ConnectTimeout time.Duration
+}
+
+func (u *mongoURI) String() string {
+	// Never log the password.
+	s := "mongodb://"
+	if u.Username != "" {
+		s += u.Username + "@"
+	}
+	s += strings.Join(u.Hosts, ",")
+	if u.ReplicaSet != "" {
+		s += "?replicaSet=" + u.ReplicaSet
+	}
+	return s
+}
+
+func parseMongoURI(s string) (*mongoURI, error) {
+	const scheme = "mongodb://"
+	if !strings.HasPrefix(s, scheme) {
+		// Not the whole uri: it may hold a password.
+		if i := strings.Index(s, "://"); i >= 0 {
+			return nil, fmt.Errorf("mongo uri: unsupported scheme %v, want %v", s[:i+3], scheme)
+		}
+		return nil, fmt.Errorf("mongo uri doesn't start with %v", scheme)
+	}
+	s = s[len(scheme):]
+	u := &mongoURI{AuthSource: "admin", ConnectTimeout: 10 * time.Second}
+
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, pass := s[:i], ""
+		if j := strings.Index(user, ":"); j >= 0 {
+			user, pass = user[:j], user[j+1:]
+		}
+		var err error
+		// Not QueryUnescape: a '+' in the credentials is a '+'.
+		if u.Username, err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("mongo uri username: %v", err)
+		}
+		if u.Password, err = url.PathUnescape(pass); err != nil {
+			return nil, errors.New("mongo uri password: invalid escaping")
+		}
+		s = s[i+1:]
+	}
+
+	var query string
+	if i := strings.Index(s, "?"); i >= 0 {
+		s, query = s[:i], s[i+1:]
+	}
+	hosts := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		hosts = s[:i]
+		if db := s[i+1:]; db != "" {
+			u.AuthSource = db
+		}
+	}
+	for _, h := range strings.Split(hosts, ",") {
+		if h == "" {
+			continue
+		}
+		if !strings.Contains(h, ":") {
+			h += ":27017"
+		}
+		u.Hosts = append(u.Hosts, h)
+	}
+	if len(u.Hosts) == 0 {
+		return nil, errors.New("mongo uri has no hosts")
+	}
+
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("mongo uri options: %v", err)
+	}
+	for k, v := range opts {
+		// Option names are case-insensitive.
+		switch strings.ToLower(k) {
+		case "authsource":
+			u.AuthSource = v[0]
+		case "replicaset":
+			u.ReplicaSet = v[0]
+		case "connecttimeoutms":
+			ms, err := strconv.Atoi(v[0])
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("mongo uri: bad connectTimeoutMS %q", v[0])
+			}
+			u.ConnectTimeout = time.Duration(ms) * time.Millisecond
+		default:
+			// Silently connecting without e.g. socketTimeoutMS or
+			// ssl would be worse than not starting.
+			return nil, fmt.Errorf("mongo uri: unsupported option %v", k)
+		}
+	}
+	return u, nil
+}
+
+// dialMongo connects to the server described by u. With a replica set, it
+// returns a connection to the primary. The connection is authenticated if u
+// has a username.
+func dialMongo(u *mongoURI) (conn mongo.Conn, err error) {
+	for _, host := range u.Hosts {
+		if conn, err = dialMongoHost(u, host); err == nil {
+			return conn, nil
+		}
+		log.Printf("mongo: %v: %v", host, err)
+	}
+	return nil, fmt.Errorf("could not connect to %v: %v", u, err)
+}
+
+func dialMongoHost(u *mongoURI, host string) (conn mongo.Conn, err error) {
+	if conn, err = dialTimeout(host, u.ConnectTimeout); err != nil {
+		return nil, err
+	}
+	if u.ReplicaSet != "" {
+		var status struct {
+			IsMaster bool   `bson:"ismaster"`
+			SetName  string `bson:"setName"`
+			Primary  string `bson:"primary"`
+		}
+		admin := mongo.Database{conn, "admin", mongo.DefaultLastErrorCmd}
+		if err = admin.Run(mongo.D{{"isMaster", 1}}, &status); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("isMaster: %v", err)
+		}
+		if status.SetName != u.ReplicaSet {
+			conn.Close()
+			return nil, fmt.Errorf("member of replica set %q, want %q", status.SetName, u.ReplicaSet)
+		}
+		if !status.IsMaster {
+			conn.Close()
+			if status.Primary == "" || status.Primary == host {
+				return nil, errors.New("replica set has no primary")
+			}
+			log.Printf("mongo: %v is a secondary, connecting to primary %v", host, status.Primary)
+			if conn, err = dialTimeout(status.Primary, u.ConnectTimeout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if u.Username != "" {
+		authDb := mongo.Database{conn, u.AuthSource, mongo.DefaultLastErrorCmd}
+		if err = authDb.Authenticate(u.Username, u.Password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authentication as %v on %v: %v", u.Username, u.AuthSource, err)
+		}
+	}
+	return conn, nil
+}
+
+// dialTimeout is mongo.Dial, giving up after timeout.
+func dialTimeout(host string, timeout time.Duration) (mongo.Conn, error) {
+	type result struct {
+		conn mongo.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := mongo.Dial(host)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Close the connection if it ever gets established.
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %v timed out after %v", host, timeout)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps the request quota of each twitter endpoint, as told by
+// the X-Rate-Limit headers of the responses, so that concurrent requests
+// share it. Each endpoint has its own quota: running out of followers/ids
+// calls doesn't stop users/lookup.
+type rateLimiter struct {
+	mu     sync.Mutex
+	quotas map[string]*endpointQuota
+}
+
+type endpointQuota struct {
+	remaining int64
+	reset     time.Time
+	// probe is set while a request is finding out a quota that is
+	// unknown, or was just reset. It's closed when that request is done.
+	probe chan struct{}
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{quotas: map[string]*endpointQuota{}}
+}
+
+func (l *rateLimiter) quota(endpoint string) *endpointQuota {
+	q := l.quotas[endpoint]
+	if q == nil {
+		q = &endpointQuota{}
+		l.quotas[endpoint] = q
+	}
+	return q
+}
+
+// wait blocks while the quota of endpoint is used up, until it's reset or
+// ctx is done. Otherwise it takes one request from the quota. While the
+// quota isn't known, only one request goes through, and probe is true for
+// it; the others wait for its response. The request must be followed by an
+// update with the same probe.
+func (l *rateLimiter) wait(ctx context.Context, endpoint string) (probe bool, err error) {
+	for {
+		l.mu.Lock()
+		q := l.quota(endpoint)
+		if q.probe != nil {
+			known := q.probe
+			l.mu.Unlock()
+			select {
+			case <-known:
+				continue
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+		if !time.Now().Before(q.reset) {
+			q.probe = make(chan struct{})
+			l.mu.Unlock()
+			return true, nil
+		}
+		if q.remaining > 0 {
+			q.remaining--
+			l.mu.Unlock()
+			return false, nil
+		}
+		sleep := q.reset.Sub(time.Now())
+		l.mu.Unlock()
+		log.Printf("Twitter API limits exceeded for %v. Sleeping for %v.\n", endpoint, sleep)
+		t := time.NewTimer(sleep)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// update records the quota of endpoint left after resp, which is nil if the
+// request failed. probe is what wait returned for the request.
+func (l *rateLimiter) update(endpoint string, resp *http.Response, probe bool) {
+	var (
+		known     bool
+		remaining int64
+		reset     time.Time
+	)
+	if resp != nil {
+		// if resp.StatusCode == 429 { // Rate limit exceeded
+		//	log.Println("Got rate limited. Printing headers")
+		// 	log.Printf("%v", resp.Header)
+		// }
+		// 1.0 was "RateLimit" instead of "Rate-Limit"
+		hreset := resp.Header.Get("X-Rate-Limit-Reset")
+		hremaining := resp.Header.Get("X-Rate-Limit-Remaining")
+		if known = hreset != "" && hremaining != ""; known {
+			remaining, _ = strconv.ParseInt(hremaining, 10, 64)
+			r, _ := strconv.ParseInt(hreset, 10, 64)
+			reset = time.Unix(r, 0)
+			if remaining < 1 && reset.Before(time.Now()) {
+				log.Printf("Rate limited by twitter but X-RateLimit-Reset is in the past: block should have expired %v ago (timestamp: %v)", time.Since(reset), hreset)
+			}
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.quota(endpoint)
+	switch {
+	case !known:
+	case reset.After(q.reset):
+		q.remaining, q.reset = remaining, reset
+	case reset.Equal(q.reset) && remaining < q.remaining:
+		// Responses can arrive out of order. In the same window, the
+		// lowest count is the latest.
+		q.remaining = remaining
+	}
+	if probe && q.probe != nil {
+		close(q.probe)
+		q.probe = nil
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sort"
+	"time"
+)
+
+var retention RetentionPolicy
+
+func init() {
+	flag.IntVar(&retention.Latest, "keepSnapshots", 10,
+		"Number of most recent followers snapshots kept for each user by the garbage collector.")
+	flag.IntVar(&retention.Daily, "keepDaily", 7,
+		"Also keep the last snapshot of each of the last N days.")
+	flag.IntVar(&retention.Weekly, "keepWeekly", 8,
+		"Also keep the last snapshot of each of the last N weeks.")
+}
+
+// RetentionPolicy says which followers snapshots of a user survive garbage
+// collection. The user_followers_counters collection is never collected.
+type RetentionPolicy struct {
+	// Latest is the number of most recent snapshots to keep. At least one
+	// is always kept.
+	Latest int
+	// Daily and Weekly keep the last snapshot of each of the last Daily days
+	// and Weekly weeks.
+	Daily  int
+	Weekly int
+}
+
+// snapshotCollector is implemented by the stores that support garbage
+// collection of old snapshots.
+type snapshotCollector interface {
+	// CollectSnapshots removes the snapshots not retained by p and returns
+	// how many records were removed, or would be removed in dry run mode.
+	CollectSnapshots(p RetentionPolicy, now time.Time) (removed int, err error)
+}
+
+// CollectSnapshots garbage collects the user_followers collection of db,
+// following the policy set by the -keep* flags.
+func CollectSnapshots(db FollowersStore) (removed int, err error) {
+	gc, ok := db.(snapshotCollector)
+	if !ok {
+		return 0, errors.New("this store doesn't support garbage collection")
+	}
+	removed, err = gc.CollectSnapshots(retention, time.Now().UTC())
+	if dryRunMode {
+		log.Printf("dryRunMode, %d snapshot records would have been removed", removed)
+	} else {
+		log.Printf("Removed %d snapshot records", removed)
+	}
+	return
+}
+
+// unretainedRecords returns which of the records of a single user can be
+// removed under p. records must be in the order they were inserted, so that
+// records sharing a date can be told apart.
+//
+// Delta records can't be read without the records before them in the same
+// chain, so a chain is only removed as a whole, when none of its snapshots
+// are retained. Records after the last retained snapshot of a chain can
+// always go.
+func unretainedRecords(records []*followersRecord, p RetentionPolicy, now time.Time) (drop []*followersRecord) {
+	// Newest first. On ties, the last one inserted is the newest.
+	sorted := make([]*followersRecord, len(records))
+	for i, r := range records {
+		sorted[len(records)-1-i] = r
+	}
+	sort.Stable(sort.Reverse(recordsByDate(sorted)))
+
+	keep := map[*followersRecord]bool{}
+	latest := p.Latest
+	if latest < 1 {
+		latest = 1
+	}
+	for i := 0; i < len(sorted) && i < latest; i++ {
+		keep[sorted[i]] = true
+	}
+	keepPeriods(sorted, keep, 24*time.Hour, p.Daily, now)
+	keepPeriods(sorted, keep, 7*24*time.Hour, p.Weekly, now)
+
+	// Position in sorted of the newest retained record of each chain,
+	// keyed by the chain's base date.
+	chains := map[int64]int{}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if r := sorted[i]; keep[r] {
+			chains[chainOf(r)] = i
+		}
+	}
+	for i, r := range sorted {
+		if newest, ok := chains[chainOf(r)]; !ok || i < newest {
+			drop = append(drop, r)
+		}
+	}
+	return
+}
+
+// chainOf returns the date of the full record r's chain starts from.
+func chainOf(r *followersRecord) int64 {
+	if r.Delta {
+		return r.Base
+	}
+	return r.Date
+}
+
+// keepPeriods marks the newest of the sorted (newest first) records in each
+// of the last n periods of length d.
+func keepPeriods(sorted []*followersRecord, keep map[*followersRecord]bool, d time.Duration, n int, now time.Time) {
+	period := int64(d / time.Second)
+	oldest := now.Unix()/period - int64(n)
+	seen := map[int64]bool{}
+	for _, r := range sorted {
+		p := r.Date / period
+		if p <= oldest {
+			break
+		}
+		if !seen[p] {
+			seen[p] = true
+			keep[r] = true
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnretainedRecords(t *testing.T) {
+	const hour = 3600
+	now := time.Unix(99*24*hour+20*hour, 0)
+	// Three crawls a day for the last 10 days, newest last. A full
+	// snapshot starts each day.
+	var records []*followersRecord
+	for day := int64(90); day < 100; day++ {
+		base := day*24*hour + 1*hour
+		for _, h := range []int64{1, 9, 17} {
+			r := &followersRecord{Uid: 1, Date: day*24*hour + h*hour}
+			if h != 1 {
+				r.Delta, r.Base = true, base
+			}
+			records = append(records, r)
+		}
+	}
+
+	drop := unretainedRecords(records, RetentionPolicy{Latest: 4, Daily: 3}, now)
+	dropped := map[int64]bool{}
+	for _, r := range drop {
+		dropped[r.Date] = true
+	}
+	var kept []int64
+	for _, r := range records {
+		if !dropped[r.Date] {
+			kept = append(kept, r.Date/hour-90*24)
+		}
+	}
+	// Hours since day 90 of the kept records: the whole chains of the last
+	// 3 days, which include the 4 latest snapshots.
+	want := []int64{
+		7*24 + 1, 7*24 + 9, 7*24 + 17,
+		8*24 + 1, 8*24 + 9, 8*24 + 17,
+		9*24 + 1, 9*24 + 9, 9*24 + 17,
+	}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+
+	// A week old keeper only keeps its chain up to itself.
+	drop = unretainedRecords(records, RetentionPolicy{Latest: 1, Weekly: 2}, now)
+	dropped = map[int64]bool{}
+	for _, r := range drop {
+		dropped[r.Date] = true
+	}
+	kept = nil
+	for _, r := range records {
+		if !dropped[r.Date] {
+			kept = append(kept, r.Date/hour-90*24)
+		}
+	}
+	// Periods are counted from the epoch, so the current week started on
+	// day 98 and day 97 has the last snapshot of the previous one.
+	want = []int64{7*24 + 1, 7*24 + 9, 7*24 + 17, 9*24 + 1, 9*24 + 9, 9*24 + 17}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("weekly: kept %v, want %v", kept, want)
+	}
+}
+
+func TestUnretainedRecordsSameDate(t *testing.T) {
+	base := &followersRecord{Uid: 1, Date: 100}
+	first := &followersRecord{Uid: 1, Date: 200, Delta: true, Base: 100}
+	// Saved again at the same date, as a new chain.
+	second := &followersRecord{Uid: 1, Date: 200}
+	drop := unretainedRecords([]*followersRecord{base, first, second}, RetentionPolicy{Latest: 1}, time.Unix(300, 0))
+	if want := []*followersRecord{first, base}; !reflect.DeepEqual(drop, want) {
+		t.Errorf("dropped %v, want %v", drop, want)
+	}
+	// When the delta is the one saved last, the other full record goes.
+	drop = unretainedRecords([]*followersRecord{base, second, first}, RetentionPolicy{Latest: 1}, time.Unix(300, 0))
+	if want := []*followersRecord{second}; !reflect.DeepEqual(drop, want) {
+		t.Errorf("dropped %v, want %v", drop, want)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"log"
+)
+
+// schemaVersion is the version of the database layout this code reads and
+// writes. Databases created before versioning existed are version 1.
+//
+// Version history:
+//
+//	1: original layout.
+//	2: previous_unfollows documents have the date of the notification.
+//	   Older ones get date 0, meaning unknown.
+//	3: previous_unfollows documents have the date the unfollower followed
+//	   again, or 0 if they haven't. Only one open (0) document is allowed
+//	   per pair.
+//	4: unfollow_events have the reason the follower left. Older ones are
+//	   all "unfollowed".
+//	5: anomalies have the date they were acknowledged, or 0 if they
+//	   weren't.
+//	6: unfollow_events have the date the unfollower followed again, or 0
+//	   if they haven't.
+const schemaVersion = 6
+
+// schemaMigrator is implemented by the stores that persist data across runs.
+type schemaMigrator interface {
+	// getSchemaVersion returns the version recorded in the database. If
+	// there is none, it returns 1 when the database has data and 0 when it
+	// is empty.
+	getSchemaVersion() (int, error)
+	setSchemaVersion(version int) error
+	// migrateTo upgrades the data from version-1 to version.
+	migrateTo(version int) error
+}
+
+// SchemaError is returned when the database layout isn't the one this code
+// expects.
+type SchemaError struct {
+	Version int
+}
+
+func (e *SchemaError) Error() string {
+	if e.Version > schemaVersion {
+		return fmt.Sprintf("database schema version %d is newer than this program's (%d), refusing to use it", e.Version, schemaVersion)
+	}
+	return fmt.Sprintf("database schema version %d is outdated, run the migrate command to upgrade it to %d", e.Version, schemaVersion)
+}
+
+// CheckSchema returns a *SchemaError if db can't be used without migrating it
+// first. New databases are marked with the current version. Once the version
+// is known to be the right one, the missing indexes are created.
+func CheckSchema(db FollowersStore) error {
+	m, ok := db.(schemaMigrator)
+	if !ok {
+		return nil
+	}
+	v, err := m.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case v == 0:
+		if dryRunMode {
+			break
+		}
+		if err := m.setSchemaVersion(schemaVersion); err != nil {
+			return err
+		}
+	case v != schemaVersion:
+		return &SchemaError{v}
+	}
+	if ix, ok := db.(indexEnsurer); ok {
+		ensureIndexes(ix)
+	}
+	return nil
+}
+
+// Migrate upgrades db to the current schema version, one version at a time.
+func Migrate(db FollowersStore) error {
+	m, ok := db.(schemaMigrator)
+	if !ok {
+		log.Println("Nothing to migrate for this store")
+		return nil
+	}
+	v, err := m.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if v > schemaVersion {
+		return &SchemaError{v}
+	}
+	if v == schemaVersion {
+		log.Printf("Database already at schema version %d", v)
+		return nil
+	}
+	if dryRunMode {
+		log.Printf("dryRunMode, not migrating the database from schema version %d to %d", v, schemaVersion)
+		return nil
+	}
+	if v == 0 {
+		log.Printf("Empty database, marking it as schema version %d", schemaVersion)
+		return m.setSchemaVersion(schemaVersion)
+	}
+	for v < schemaVersion {
+		v++
+		log.Printf("Migrating database to schema version %d", v)
+		if err := m.migrateTo(v); err != nil {
+			return fmt.Errorf("migration to schema version %d: %v", v, err)
+		}
+		if err := m.setSchemaVersion(v); err != nil {
+			return err
+		}
+	}
+	// Migrations may have made room for new indexes.
+	if ix, ok := db.(indexEnsurer); ok {
+		ensureIndexes(ix)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+var fullSnapshotEvery int
+
+func init() {
+	flag.IntVar(&fullSnapshotEvery, "fullSnapshotEvery", 20,
+		"Save the complete followers list every N snapshots. The ones in between only keep what changed.")
+}
+
+// followersRecord is a followers snapshot as stored in the user_followers
+// collection.
+//
+// A full record has the complete Followers list. A delta record only has the
+// ids Added and Removed since the previous record, and Base is the date of
+// the full record its chain starts from. Records saved before delta encoding
+// existed don't have the delta field, and are full.
+type followersRecord struct {
+	// Id is the record's _id in MongoDB, or its rowid in SQLite. It's only
+	// read by the garbage collector, since records of a user can share a
+	// date.
+	Id        interface{} `bson:"_id,omitempty"`
+	Uid       int64       `bson:"uid"`
+	Date      int64       `bson:"date"`
+	Delta     bool        `bson:"delta,omitempty"`
+	Base      int64       `bson:"base,omitempty"`
+	Followers []int64     `bson:"followers,omitempty"`
+	Added     []int64     `bson:"added,omitempty"`
+	Removed   []int64     `bson:"removed,omitempty"`
+}
+
+// recordStore is implemented by the backends so the delta encoding logic
+// can be shared.
+type recordStore interface {
+	// latestChain returns the full record and the deltas, sorted by date,
+	// needed to rebuild the latest snapshot of uid. base is nil if there is
+	// no snapshot for uid.
+	latestChain(uid int64) (base *followersRecord, deltas []*followersRecord, err error)
+	insertRecord(r *followersRecord) error
+}
+
+func getUserFollowersFromRecords(s recordStore, uid int64) (*userFollowers, error) {
+	base, deltas, err := s.latestChain(uid)
+	if err != nil || base == nil {
+		return nil, err
+	}
+	return replayFollowers(base, deltas)
+}
+
+// insertFollowersRecord saves uf either as a delta of the latest snapshot or,
+// when starting a new chain is cheaper or due, as a full record.
+func insertFollowersRecord(s recordStore, uf *userFollowers) error {
+	base, deltas, err := s.latestChain(uf.Uid)
+	if err != nil {
+		return err
+	}
+	var prev *userFollowers
+	if base != nil {
+		if prev, err = replayFollowers(base, deltas); err != nil {
+			// Don't build on top of a broken chain.
+			prev = nil
+		}
+	}
+	return s.insertRecord(newFollowersRecord(base, len(deltas), prev, uf))
+}
+
+// newFollowersRecord returns the record to store for uf, given the latest
+// chain (its base and number of deltas) and the snapshot prev it rebuilds to.
+func newFollowersRecord(base *followersRecord, numDeltas int, prev, uf *userFollowers) *followersRecord {
+	full := &followersRecord{Uid: uf.Uid, Date: uf.Date, Followers: uf.Followers}
+	if prev == nil || prev.Date >= uf.Date || numDeltas+1 >= fullSnapshotEvery {
+		return full
+	}
+	added, removed := followersDelta(prev.Followers, uf.Followers)
+	if len(added)+len(removed) >= len(uf.Followers)/2 {
+		// Not worth it.
+		return full
+	}
+	return &followersRecord{
+		Uid:     uf.Uid,
+		Date:    uf.Date,
+		Delta:   true,
+		Base:    base.Date,
+		Added:   added,
+		Removed: removed,
+	}
+}
+
+// followersDelta returns the ids present in cur but not in prev, and the ones
+// present in prev but not in cur.
+func followersDelta(prev, cur []int64) (added, removed []int64) {
+	prevMap := make(map[int64]bool, len(prev))
+	for _, uid := range prev {
+		prevMap[uid] = true
+	}
+	curMap := make(map[int64]bool, len(cur))
+	for _, uid := range cur {
+		curMap[uid] = true
+		if !prevMap[uid] {
+			added = append(added, uid)
+		}
+	}
+	for _, uid := range prev {
+		if !curMap[uid] {
+			removed = append(removed, uid)
+		}
+	}
+	return
+}
+
+// replayFollowers applies deltas, in order, to the base record. New followers
+// are put first, like twitter does.
+func replayFollowers(base *followersRecord, deltas []*followersRecord) (*userFollowers, error) {
+	if base.Delta {
+		return nil, fmt.Errorf("snapshot chain for uid %d starts with a delta record (date %d)", base.Uid, base.Date)
+	}
+	followers := append([]int64(nil), base.Followers...)
+	date := base.Date
+	for _, d := range deltas {
+		if !d.Delta || d.Base != base.Date || d.Date <= date {
+			return nil, fmt.Errorf("broken snapshot chain for uid %d: record %d doesn't follow %d", base.Uid, d.Date, date)
+		}
+		removed := make(map[int64]bool, len(d.Removed))
+		for _, uid := range d.Removed {
+			removed[uid] = true
+		}
+		next := make([]int64, 0, len(followers)+len(d.Added)-len(d.Removed))
+		next = append(next, d.Added...)
+		for _, uid := range followers {
+			if !removed[uid] {
+				next = append(next, uid)
+			}
+		}
+		followers = next
+		date = d.Date
+	}
+	return &userFollowers{base.Uid, date, followers}, nil
+}
+
+// latestChainOf picks the latest chain out of all the records of a user. It's
+// for backends that can't query for the chain directly.
+func latestChainOf(records []*followersRecord) (base *followersRecord, deltas []*followersRecord, err error) {
+	var latest *followersRecord
+	for _, r := range records {
+		// On ties, the last one inserted wins.
+		if latest == nil || r.Date >= latest.Date {
+			latest = r
+		}
+	}
+	if latest == nil || !latest.Delta {
+		return latest, nil, nil
+	}
+	for _, r := range records {
+		switch {
+		case !r.Delta && r.Date == latest.Base:
+			base = r
+		case r.Delta && r.Base == latest.Base && r.Date <= latest.Date:
+			deltas = append(deltas, r)
+		}
+	}
+	if base == nil {
+		return nil, nil, fmt.Errorf("missing full snapshot %d for uid %d", latest.Base, latest.Uid)
+	}
+	sort.Sort(recordsByDate(deltas))
+	return base, deltas, nil
+}
+
+type recordsByDate []*followersRecord
+
+func (r recordsByDate) Len() int           { return len(r) }
+func (r recordsByDate) Less(i, j int) bool { return r[i].Date < r[j].Date }
+func (r recordsByDate) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
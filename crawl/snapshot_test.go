@@ -0,0 +1,97 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sortedUids(uids []int64) []int64 {
+	s := append([]int64(nil), uids...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+func TestDeltaSnapshots(t *testing.T) {
+	defer func(d bool, n int) { dryRunMode, fullSnapshotEvery = d, n }(dryRunMode, fullSnapshotEvery)
+	dryRunMode, fullSnapshotEvery = false, 3
+
+	mem := NewMemoryDatabase()
+	stores := map[string]FollowersStore{
+		"memory": mem,
+		"sqlite": newTestSQLiteDatabase(t),
+	}
+	followers := make([]int64, 0, 100)
+	for uid := int64(1000); uid < 1100; uid++ {
+		followers = append(followers, uid)
+	}
+	snapshots := [][]int64{
+		followers,
+		append([]int64{2000}, followers[1:]...),
+		followers[2:],
+		append([]int64{2001, 2002}, followers[2:]...),
+		followers[10:],
+	}
+	for name, s := range stores {
+		for i, f := range snapshots {
+			if err := s.Insert(&userFollowers{testExistingUser, int64(i + 1), f}); err != nil {
+				t.Fatalf("%s #%d Insert: %v", name, i, err)
+			}
+			uf, err := s.GetUserFollowers(testExistingUser)
+			if err != nil {
+				t.Fatalf("%s #%d GetUserFollowers: %v", name, i, err)
+			}
+			if uf == nil || uf.Date != int64(i+1) || !reflect.DeepEqual(sortedUids(uf.Followers), sortedUids(f)) {
+				t.Errorf("%s #%d expected\n%v\ngot\n%v", name, i, f, uf)
+			}
+		}
+	}
+
+	// With a full snapshot every 3, the records should be: full, delta,
+	// delta, full, delta.
+	var deltas []bool
+	for _, r := range mem.records[testExistingUser] {
+		deltas = append(deltas, r.Delta)
+	}
+	if want := []bool{false, true, true, false, true}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("record types: got %v, want delta=%v", deltas, want)
+	}
+}
+
+func TestSnapshotSameDate(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	stores := map[string]FollowersStore{
+		"memory": NewMemoryDatabase(),
+		"sqlite": newTestSQLiteDatabase(t),
+	}
+	for name, s := range stores {
+		for _, f := range [][]int64{{1, 2, 3}, {1, 2}} {
+			if err := s.Insert(&userFollowers{testExistingUser, 10, f}); err != nil {
+				t.Fatalf("%s Insert: %v", name, err)
+			}
+		}
+		uf, err := s.GetUserFollowers(testExistingUser)
+		if err != nil {
+			t.Fatalf("%s GetUserFollowers: %v", name, err)
+		}
+		if uf == nil || !reflect.DeepEqual(sortedUids(uf.Followers), []int64{1, 2}) {
+			t.Errorf("%s: with equal dates, expected the last snapshot [1 2], got %v", name, uf)
+		}
+	}
+}
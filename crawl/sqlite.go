@@ -0,0 +1,733 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqlitePath string
+
+func init() {
+	flag.StringVar(&sqlitePath, "sqlitePath", "unfollow.db",
+		"Path of the sqlite database file, used with -store=sqlite.")
+}
+
+// The tables mirror the mongo collections. Lists of uids are stored as JSON
+// arrays.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ` + USER_FOLLOWERS_TABLE + ` (
+		uid       INTEGER NOT NULL,
+		date      INTEGER NOT NULL,
+		followers TEXT    NOT NULL,
+		delta     INTEGER NOT NULL DEFAULT 0,
+		base      INTEGER NOT NULL DEFAULT 0,
+		added     TEXT    NOT NULL DEFAULT 'null',
+		removed   TEXT    NOT NULL DEFAULT 'null'
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + USER_FOLLOWERS_COUNTERS_TABLE + ` (
+		uid            INTEGER NOT NULL,
+		date           INTEGER NOT NULL,
+		followerscount INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + FOLLOW_PENDING_TABLE + ` (
+		uid  INTEGER NOT NULL,
+		date INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + PREVIOUS_UNFOLLOWS_TABLE + ` (
+		uid        INTEGER NOT NULL,
+		unfollower INTEGER NOT NULL,
+		date       INTEGER NOT NULL DEFAULT 0,
+		refollowed INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + UNFOLLOW_EVENTS_TABLE + ` (
+		uid          INTEGER NOT NULL,
+		unfollower   INTEGER NOT NULL,
+		detected     INTEGER NOT NULL,
+		prevsnapshot INTEGER NOT NULL,
+		newsnapshot  INTEGER NOT NULL,
+		reason       TEXT    NOT NULL DEFAULT '` + ReasonUnfollowed + `',
+		status       TEXT    NOT NULL,
+		refollowed   INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + USER_SETTINGS_TABLE + ` (
+		uid          INTEGER NOT NULL PRIMARY KEY,
+		newfollowers TEXT    NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + SCREEN_NAMES_TABLE + ` (
+		uid         INTEGER NOT NULL PRIMARY KEY,
+		screen_name TEXT    NOT NULL,
+		fetched     INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + SUSPECTED_UNFOLLOWS_TABLE + ` (
+		uid          INTEGER NOT NULL,
+		unfollower   INTEGER NOT NULL,
+		firstmissing INTEGER NOT NULL,
+		misses       INTEGER NOT NULL,
+		PRIMARY KEY (uid, unfollower)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + ANOMALIES_TABLE + ` (
+		uid           INTEGER NOT NULL,
+		kind          TEXT    NOT NULL,
+		detected      INTEGER NOT NULL,
+		prevsnapshot  INTEGER NOT NULL,
+		newsnapshot   INTEGER NOT NULL,
+		prevfollowers INTEGER NOT NULL,
+		newfollowers  INTEGER NOT NULL,
+		missing       INTEGER NOT NULL,
+		acknowledged  INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + IGNORE_LIST_TABLE + ` (
+		uid   INTEGER NOT NULL,
+		scope TEXT    NOT NULL,
+		PRIMARY KEY (uid, scope)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + CRAWL_RUNS_TABLE + ` (
+		id       INTEGER NOT NULL PRIMARY KEY,
+		finished INTEGER NOT NULL,
+		current  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + CRAWL_PROGRESS_TABLE + ` (
+		run INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		PRIMARY KEY (run, uid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + FOLLOWERS_PAGES_TABLE + ` (
+		uid         INTEGER NOT NULL,
+		seq         INTEGER NOT NULL,
+		started     INTEGER NOT NULL,
+		cursor      INTEGER NOT NULL,
+		next_cursor INTEGER NOT NULL,
+		ids         TEXT    NOT NULL,
+		PRIMARY KEY (uid, seq)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + SCHEMA_VERSION_TABLE + ` (
+		version INTEGER NOT NULL
+	)`,
+}
+
+// SQLiteDatabase is a FollowersStore kept in a single sqlite file, for
+// deployments that don't want to run a mongo server.
+type SQLiteDatabase struct {
+	db *sql.DB
+}
+
+func NewSQLiteDatabase(path string) (*SQLiteDatabase, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite open %v: %v", path, err)
+	}
+	// sqlite only allows one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite schema: %v", err)
+		}
+	}
+	// Indexes and columns are left to CheckSchema and Migrate, which know
+	// whether this program can touch the file.
+	return &SQLiteDatabase{db: db}, nil
+}
+
+// addSQLiteColumn adds the column described by def to table, unless it's
+// already there.
+func addSQLiteColumn(db *sql.DB, table, def string) error {
+	name := strings.Fields(def)[0]
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		var colName string
+		for i := range values {
+			if cols[i] == "name" {
+				values[i] = &colName
+			} else {
+				values[i] = new(interface{})
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		if colName == name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + def)
+	return err
+}
+
+func (s *SQLiteDatabase) Close() error {
+	return s.db.Close()
+}
+
+// Insert saves the snapshot and updates the counters table, like
+// FollowersDatabase.Insert.
+func (s *SQLiteDatabase) Insert(uf *userFollowers) (err error) {
+	if dryRunMode {
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = insertFollowersRecord(sqliteTx{tx}, uf); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO "+USER_FOLLOWERS_COUNTERS_TABLE+" (uid, date, followerscount) VALUES (?, ?, ?)",
+		uf.Uid, uf.Date, len(uf.Followers)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) GetUserFollowers(uid int64) (uf *userFollowers, err error) {
+	return getUserFollowersFromRecords(sqliteTx{s.db}, uid)
+}
+
+// sqliteQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqliteQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqliteTx implements recordStore on top of a database or a transaction.
+type sqliteTx struct {
+	q sqliteQuerier
+}
+
+const sqliteRecordColumns = "uid, date, delta, base, followers, added, removed"
+
+func (t sqliteTx) latestChain(uid int64) (base *followersRecord, deltas []*followersRecord, err error) {
+	latest, err := t.findRecords("WHERE uid = ? ORDER BY date DESC, rowid DESC LIMIT 1", uid)
+	if err != nil || len(latest) == 0 {
+		return
+	}
+	last := latest[0]
+	if !last.Delta {
+		return last, nil, nil
+	}
+	bases, err := t.findRecords("WHERE uid = ? AND date = ? AND delta = 0 LIMIT 1", uid, last.Base)
+	if err != nil {
+		return
+	}
+	if len(bases) == 0 {
+		return nil, nil, fmt.Errorf("missing full snapshot %d for uid %d", last.Base, uid)
+	}
+	deltas, err = t.findRecords("WHERE uid = ? AND delta = 1 AND base = ? AND date <= ? ORDER BY date",
+		uid, last.Base, last.Date)
+	if err != nil {
+		return
+	}
+	return bases[0], deltas, nil
+}
+
+func (t sqliteTx) insertRecord(r *followersRecord) error {
+	var lists [3][]byte
+	for i, l := range [][]int64{r.Followers, r.Added, r.Removed} {
+		b, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		lists[i] = b
+	}
+	_, err := t.q.Exec("INSERT INTO "+USER_FOLLOWERS_TABLE+" ("+sqliteRecordColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		r.Uid, r.Date, r.Delta, r.Base, string(lists[0]), string(lists[1]), string(lists[2]))
+	return err
+}
+
+func (t sqliteTx) findRecords(where string, args ...interface{}) (records []*followersRecord, err error) {
+	rows, err := t.q.Query("SELECT "+sqliteRecordColumns+" FROM "+USER_FOLLOWERS_TABLE+" "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			r                         followersRecord
+			followers, added, removed string
+		)
+		if err = rows.Scan(&r.Uid, &r.Date, &r.Delta, &r.Base, &followers, &added, &removed); err != nil {
+			return nil, err
+		}
+		for _, l := range []struct {
+			s    string
+			dest *[]int64
+		}{{followers, &r.Followers}, {added, &r.Added}, {removed, &r.Removed}} {
+			if err = json.Unmarshal([]byte(l.s), l.dest); err != nil {
+				return nil, fmt.Errorf("sqlite followers decoding for uid %d: %v", r.Uid, err)
+			}
+		}
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteDatabase) MarkPendingFollow(uid int64) error {
+	_, err := s.db.Exec("INSERT INTO "+FOLLOW_PENDING_TABLE+" (uid, date) VALUES (?, ?)",
+		uid, time.Now().UTC().Unix())
+	return err
+}
+
+func (s *SQLiteDatabase) GetIsFollowingPending(uid int64) (isPending bool, err error) {
+	return s.exists("SELECT 1 FROM "+FOLLOW_PENDING_TABLE+" WHERE uid = ? LIMIT 1", uid)
+}
+
+func (s *SQLiteDatabase) GetWasUnfollowNotified(abandonedUser, unfollower int64) (wasNotified bool) {
+	wasNotified, _ = s.exists("SELECT 1 FROM "+PREVIOUS_UNFOLLOWS_TABLE+
+		" WHERE uid = ? AND unfollower = ? AND refollowed = 0 LIMIT 1", abandonedUser, unfollower)
+	return
+}
+
+func (s *SQLiteDatabase) MarkRefollow(abandonedUser, follower int64) (wasUnfollower bool, err error) {
+	if dryRunMode {
+		wasUnfollower, err = s.exists("SELECT 1 FROM "+UNFOLLOW_EVENTS_TABLE+
+			" WHERE uid = ? AND unfollower = ? AND refollowed = 0 LIMIT 1", abandonedUser, follower)
+		return wasUnfollower || s.GetWasUnfollowNotified(abandonedUser, follower), err
+	}
+	now := time.Now().UTC().Unix()
+	// Notified unfollows from before the events were recorded are only in
+	// previous_unfollows.
+	for _, table := range []string{UNFOLLOW_EVENTS_TABLE, PREVIOUS_UNFOLLOWS_TABLE} {
+		res, err := s.db.Exec("UPDATE "+table+" SET refollowed = ? WHERE uid = ? AND unfollower = ? AND refollowed = 0",
+			now, abandonedUser, follower)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		wasUnfollower = wasUnfollower || n > 0
+	}
+	return wasUnfollower, nil
+}
+
+func (s *SQLiteDatabase) MarkUnfollowNotified(abandonedUser, unfollower int64) error {
+	_, err := s.db.Exec("INSERT INTO "+PREVIOUS_UNFOLLOWS_TABLE+" (uid, unfollower, date) VALUES (?, ?, ?)",
+		abandonedUser, unfollower, time.Now().UTC().Unix())
+	return err
+}
+
+func (s *SQLiteDatabase) RecordUnfollowEvent(e *UnfollowEvent) error {
+	_, err := s.db.Exec("INSERT INTO "+UNFOLLOW_EVENTS_TABLE+
+		" (uid, unfollower, detected, prevsnapshot, newsnapshot, reason, status) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.Uid, e.Unfollower, e.DetectedAt, e.PrevSnapshotDate, e.NewSnapshotDate, e.Reason, e.Status)
+	return err
+}
+
+func (s *SQLiteDatabase) UnfollowEventsByUser(uid int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return s.findUnfollowEvents("uid", uid, from, to)
+}
+
+func (s *SQLiteDatabase) UnfollowEventsByUnfollower(unfollower int64, from, to time.Time) ([]*UnfollowEvent, error) {
+	return s.findUnfollowEvents("unfollower", unfollower, from, to)
+}
+
+func (s *SQLiteDatabase) findUnfollowEvents(column string, uid int64, from, to time.Time) (events []*UnfollowEvent, err error) {
+	rows, err := s.db.Query("SELECT uid, unfollower, detected, prevsnapshot, newsnapshot, reason, status, refollowed FROM "+
+		UNFOLLOW_EVENTS_TABLE+" WHERE "+column+" = ? AND detected >= ? AND detected < ? ORDER BY detected",
+		uid, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := new(UnfollowEvent)
+		if err = rows.Scan(&e.Uid, &e.Unfollower, &e.DetectedAt, &e.PrevSnapshotDate, &e.NewSnapshotDate, &e.Reason, &e.Status, &e.Refollowed); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteDatabase) GetUserSettings(uid int64) (*UserSettings, error) {
+	settings := defaultUserSettings(uid)
+	err := s.db.QueryRow("SELECT newfollowers FROM "+USER_SETTINGS_TABLE+" WHERE uid = ?", uid).Scan(&settings.NewFollowers)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *SQLiteDatabase) SaveUserSettings(settings *UserSettings) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO "+USER_SETTINGS_TABLE+" (uid, newfollowers) VALUES (?, ?)",
+		settings.Uid, settings.NewFollowers)
+	return err
+}
+
+func (s *SQLiteDatabase) GetScreenName(uid int64) (screenName string, fetched int64, err error) {
+	err = s.db.QueryRow("SELECT screen_name, fetched FROM "+SCREEN_NAMES_TABLE+" WHERE uid = ?", uid).Scan(&screenName, &fetched)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (s *SQLiteDatabase) SaveScreenName(uid int64, screenName string, fetched int64) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO "+SCREEN_NAMES_TABLE+" (uid, screen_name, fetched) VALUES (?, ?, ?)",
+		uid, screenName, fetched)
+	return err
+}
+
+func (s *SQLiteDatabase) SuspectedUnfollows(uid int64) (suspects []*SuspectedUnfollow, err error) {
+	rows, err := s.db.Query("SELECT uid, unfollower, firstmissing, misses FROM "+SUSPECTED_UNFOLLOWS_TABLE+" WHERE uid = ?", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		su := new(SuspectedUnfollow)
+		if err = rows.Scan(&su.Uid, &su.Unfollower, &su.FirstMissing, &su.Misses); err != nil {
+			return nil, err
+		}
+		suspects = append(suspects, su)
+	}
+	return suspects, rows.Err()
+}
+
+func (s *SQLiteDatabase) SaveSuspectedUnfollow(su *SuspectedUnfollow) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO "+SUSPECTED_UNFOLLOWS_TABLE+" (uid, unfollower, firstmissing, misses) VALUES (?, ?, ?, ?)",
+		su.Uid, su.Unfollower, su.FirstMissing, su.Misses)
+	return err
+}
+
+func (s *SQLiteDatabase) ClearSuspectedUnfollow(uid, unfollower int64) error {
+	_, err := s.db.Exec("DELETE FROM "+SUSPECTED_UNFOLLOWS_TABLE+" WHERE uid = ? AND unfollower = ?", uid, unfollower)
+	return err
+}
+
+func (s *SQLiteDatabase) RecordAnomaly(a *Anomaly) error {
+	_, err := s.db.Exec("INSERT INTO "+ANOMALIES_TABLE+
+		" (uid, kind, detected, prevsnapshot, newsnapshot, prevfollowers, newfollowers, missing) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.Uid, a.Kind, a.DetectedAt, a.PrevSnapshotDate, a.NewSnapshotDate, a.PrevFollowers, a.NewFollowers, a.Missing)
+	return err
+}
+
+func (s *SQLiteDatabase) Anomalies(from, to time.Time) (anomalies []*Anomaly, err error) {
+	rows, err := s.db.Query("SELECT uid, kind, detected, prevsnapshot, newsnapshot, prevfollowers, newfollowers, missing, acknowledged FROM "+
+		ANOMALIES_TABLE+" WHERE detected >= ? AND detected < ? ORDER BY detected", from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := new(Anomaly)
+		if err = rows.Scan(&a.Uid, &a.Kind, &a.DetectedAt, &a.PrevSnapshotDate, &a.NewSnapshotDate,
+			&a.PrevFollowers, &a.NewFollowers, &a.Missing, &a.Acknowledged); err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, a)
+	}
+	return anomalies, rows.Err()
+}
+
+func (s *SQLiteDatabase) AcknowledgeAnomalies(uid, prevSnapshotDate, at int64) (found bool, err error) {
+	res, err := s.db.Exec("UPDATE "+ANOMALIES_TABLE+" SET acknowledged = ? WHERE uid = ? AND prevsnapshot = ?",
+		at, uid, prevSnapshotDate)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDatabase) AnomalyAcknowledged(uid, prevSnapshotDate int64) (bool, error) {
+	return s.exists("SELECT 1 FROM "+ANOMALIES_TABLE+" WHERE uid = ? AND prevsnapshot = ? AND acknowledged != 0 LIMIT 1",
+		uid, prevSnapshotDate)
+}
+
+func (s *SQLiteDatabase) IgnoreList() (entries []*IgnoreEntry, err error) {
+	rows, err := s.db.Query("SELECT uid, scope FROM " + IGNORE_LIST_TABLE + " ORDER BY uid, scope")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := new(IgnoreEntry)
+		if err = rows.Scan(&e.Uid, &e.Scope); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLiteDatabase) SaveIgnoreEntry(e *IgnoreEntry) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO "+IGNORE_LIST_TABLE+" (uid, scope) VALUES (?, ?)", e.Uid, e.Scope)
+	return err
+}
+
+func (s *SQLiteDatabase) DeleteIgnoreEntry(e *IgnoreEntry) error {
+	_, err := s.db.Exec("DELETE FROM "+IGNORE_LIST_TABLE+" WHERE uid = ? AND scope = ?", e.Uid, e.Scope)
+	return err
+}
+
+func (s *SQLiteDatabase) LatestCrawlRun() (*CrawlRun, error) {
+	r := new(CrawlRun)
+	err := s.db.QueryRow("SELECT id, finished, current FROM "+CRAWL_RUNS_TABLE+" ORDER BY id DESC LIMIT 1").
+		Scan(&r.Id, &r.Finished, &r.Current)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *SQLiteDatabase) SaveCrawlRun(r *CrawlRun) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO "+CRAWL_RUNS_TABLE+" (id, finished, current) VALUES (?, ?, ?)",
+		r.Id, r.Finished, r.Current)
+	return err
+}
+
+func (s *SQLiteDatabase) MarkUserCrawled(run, uid int64) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO "+CRAWL_PROGRESS_TABLE+" (run, uid) VALUES (?, ?)", run, uid)
+	return err
+}
+
+func (s *SQLiteDatabase) CrawledUsers(run int64) (uids []int64, err error) {
+	rows, err := s.db.Query("SELECT uid FROM "+CRAWL_PROGRESS_TABLE+" WHERE run = ?", run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int64
+		if err = rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+func (s *SQLiteDatabase) ClearCrawledUsers(run int64) error {
+	_, err := s.db.Exec("DELETE FROM "+CRAWL_PROGRESS_TABLE+" WHERE run < ?", run)
+	return err
+}
+
+func (s *SQLiteDatabase) FollowersPages(uid int64) (pages []*FollowersPage, err error) {
+	rows, err := s.db.Query("SELECT uid, seq, started, cursor, next_cursor, ids FROM "+FOLLOWERS_PAGES_TABLE+
+		" WHERE uid = ? ORDER BY seq", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			p   FollowersPage
+			ids string
+		)
+		if err = rows.Scan(&p.Uid, &p.Seq, &p.Started, &p.Cursor, &p.NextCursor, &ids); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(ids), &p.Ids); err != nil {
+			return nil, fmt.Errorf("sqlite followers page decoding for uid %d: %v", p.Uid, err)
+		}
+		pages = append(pages, &p)
+	}
+	return pages, rows.Err()
+}
+
+func (s *SQLiteDatabase) SaveFollowersPage(p *FollowersPage) error {
+	ids, err := json.Marshal(p.Ids)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO "+FOLLOWERS_PAGES_TABLE+
+		" (uid, seq, started, cursor, next_cursor, ids) VALUES (?, ?, ?, ?, ?, ?)",
+		p.Uid, p.Seq, p.Started, p.Cursor, p.NextCursor, string(ids))
+	return err
+}
+
+func (s *SQLiteDatabase) DeleteFollowersPages(uid int64) error {
+	_, err := s.db.Exec("DELETE FROM "+FOLLOWERS_PAGES_TABLE+" WHERE uid = ?", uid)
+	return err
+}
+
+// exists reports whether query returns at least one row.
+func (s *SQLiteDatabase) exists(query string, args ...interface{}) (bool, error) {
+	var one int
+	err := s.db.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLiteDatabase) CollectSnapshots(p RetentionPolicy, now time.Time) (removed int, err error) {
+	rows, err := s.db.Query("SELECT rowid, uid, date, delta, base FROM " + USER_FOLLOWERS_TABLE + " ORDER BY uid, rowid")
+	if err != nil {
+		return 0, err
+	}
+	var (
+		drop    []*followersRecord
+		records []*followersRecord
+	)
+	for rows.Next() {
+		var rowid int64
+		r := new(followersRecord)
+		if err = rows.Scan(&rowid, &r.Uid, &r.Date, &r.Delta, &r.Base); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if len(records) > 0 && records[0].Uid != r.Uid {
+			drop = append(drop, unretainedRecords(records, p, now)...)
+			records = nil
+		}
+		r.Id = rowid
+		records = append(records, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	drop = append(drop, unretainedRecords(records, p, now)...)
+	if dryRunMode {
+		return len(drop), nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range drop {
+		if _, err = tx.Exec("DELETE FROM "+USER_FOLLOWERS_TABLE+" WHERE rowid = ?", r.Id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(drop), nil
+}
+
+func (s *SQLiteDatabase) getSchemaVersion() (version int, err error) {
+	err = s.db.QueryRow("SELECT version FROM " + SCHEMA_VERSION_TABLE + " LIMIT 1").Scan(&version)
+	if err != sql.ErrNoRows {
+		return version, err
+	}
+	for _, table := range []string{USER_FOLLOWERS_TABLE, PREVIOUS_UNFOLLOWS_TABLE, FOLLOW_PENDING_TABLE, UNFOLLOW_EVENTS_TABLE} {
+		hasData, err := s.exists("SELECT 1 FROM " + table + " LIMIT 1")
+		if err != nil || hasData {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+func (s *SQLiteDatabase) setSchemaVersion(version int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM " + SCHEMA_VERSION_TABLE); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO "+SCHEMA_VERSION_TABLE+" (version) VALUES (?)", version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) migrateTo(version int) error {
+	switch version {
+	case 2:
+		// Files created before delta encoding don't have the delta
+		// columns either.
+		for _, col := range []string{
+			"delta INTEGER NOT NULL DEFAULT 0",
+			"base INTEGER NOT NULL DEFAULT 0",
+			"added TEXT NOT NULL DEFAULT 'null'",
+			"removed TEXT NOT NULL DEFAULT 'null'",
+		} {
+			if err := addSQLiteColumn(s.db, USER_FOLLOWERS_TABLE, col); err != nil {
+				return err
+			}
+		}
+		return addSQLiteColumn(s.db, PREVIOUS_UNFOLLOWS_TABLE, "date INTEGER NOT NULL DEFAULT 0")
+	case 3:
+		if err := addSQLiteColumn(s.db, PREVIOUS_UNFOLLOWS_TABLE, "refollowed INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		// Replaced by the one including refollowed.
+		_, err := s.db.Exec("DROP INDEX IF EXISTS " + PREVIOUS_UNFOLLOWS_TABLE + "_uid_1_unfollower_1")
+		return err
+	case 4:
+		return addSQLiteColumn(s.db, UNFOLLOW_EVENTS_TABLE, "reason TEXT NOT NULL DEFAULT '"+ReasonUnfollowed+"'")
+	case 5:
+		return addSQLiteColumn(s.db, ANOMALIES_TABLE, "acknowledged INTEGER NOT NULL DEFAULT 0")
+	case 6:
+		return addSQLiteColumn(s.db, UNFOLLOW_EVENTS_TABLE, "refollowed INTEGER NOT NULL DEFAULT 0")
+	}
+	return fmt.Errorf("no migration to version %d", version)
+}
+
+func (s *SQLiteDatabase) ensureIndex(ix indexSpec) (created bool, err error) {
+	name := ix.Table + "_" + strings.Replace(ix.name(), "-", "", -1)
+	exists, err := s.exists("SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = ?", name)
+	if err != nil || exists {
+		return false, err
+	}
+	if dryRunMode {
+		return true, nil
+	}
+	cols := make([]string, 0, len(ix.Keys))
+	for _, k := range ix.Keys {
+		col := k.Field
+		if k.Order < 0 {
+			col += " DESC"
+		}
+		cols = append(cols, col)
+	}
+	stmt := "CREATE INDEX "
+	if ix.Unique {
+		stmt = "CREATE UNIQUE INDEX "
+	}
+	stmt += name + " ON " + ix.Table + " (" + strings.Join(cols, ", ") + ")"
+	if _, err = s.db.Exec(stmt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteDatabase(t *testing.T) *SQLiteDatabase {
+	dir, err := ioutil.TempDir("", "javaitarde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := NewSQLiteDatabase(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteUserFollowers(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	s := newTestSQLiteDatabase(t)
+	if u, err := s.GetUserFollowers(testMissingUser); err != nil || u != nil {
+		t.Fatalf("GetUserFollowers(testMissingUser) = %v, %v; want nil, nil", u, err)
+	}
+	older := &userFollowers{testExistingUser, 100, []int64{1000, 2000, 3000}}
+	newer := &userFollowers{testExistingUser, 200, []int64{1000, 3000}}
+	// Insert out of order; the latest date must win.
+	for _, uf := range []*userFollowers{newer, older} {
+		if err := s.Insert(uf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := s.GetUserFollowers(testExistingUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, newer) {
+		t.Errorf("GetUserFollowers: expected %v, got %v", newer, u)
+	}
+}
+
+func TestSQLiteNotifications(t *testing.T) {
+	s := newTestSQLiteDatabase(t)
+	if s.GetWasUnfollowNotified(1, 2) {
+		t.Error("unexpected notification for empty database")
+	}
+	if err := s.MarkUnfollowNotified(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !s.GetWasUnfollowNotified(1, 2) {
+		t.Error("MarkUnfollowNotified(1, 2) not recorded")
+	}
+	if s.GetWasUnfollowNotified(2, 1) {
+		t.Error("GetWasUnfollowNotified(2, 1) should be false")
+	}
+	if err := s.MarkPendingFollow(3); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := s.GetIsFollowingPending(3); err != nil || !p {
+		t.Errorf("GetIsFollowingPending(3) = %v, %v; want true", p, err)
+	}
+}
+
+func TestSQLiteMarkRefollow(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	s := newTestSQLiteDatabase(t)
+	if err := s.RecordUnfollowEvent(&UnfollowEvent{Uid: 1, Unfollower: 2, DetectedAt: 10, Reason: ReasonSuspended, Status: UnfollowSuppressed}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		if back, err := s.MarkRefollow(1, 2); err != nil || back != want {
+			t.Errorf("#%d MarkRefollow(1, 2) = %v, %v; want %v", i, back, err, want)
+		}
+	}
+	events, err := s.UnfollowEventsByUser(1, time.Unix(0, 0), time.Unix(100, 0))
+	if err != nil || len(events) != 1 || events[0].Refollowed == 0 {
+		t.Errorf("UnfollowEventsByUser = %v, %v; want the refollow recorded", events, err)
+	}
+}
+
+func TestSQLiteSuspectedUnfollows(t *testing.T) {
+	s := newTestSQLiteDatabase(t)
+	for misses := 1; misses <= 2; misses++ {
+		if err := s.SaveSuspectedUnfollow(&SuspectedUnfollow{1, 2, 100, misses}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveSuspectedUnfollow(&SuspectedUnfollow{1, 3, 200, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ClearSuspectedUnfollow(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	suspects, err := s.SuspectedUnfollows(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*SuspectedUnfollow{{1, 2, 100, 2}}
+	if !reflect.DeepEqual(suspects, want) {
+		t.Errorf("got %v, want %v", suspects, want)
+	}
+}
+
+func TestSQLiteAcknowledgeAnomalies(t *testing.T) {
+	s := newTestSQLiteDatabase(t)
+	if err := s.RecordAnomaly(&Anomaly{Uid: 1, Kind: AnomalyMassUnfollow, DetectedAt: 20, PrevSnapshotDate: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.AcknowledgeAnomalies(1, 5, 30); err != nil || found {
+		t.Errorf("AcknowledgeAnomalies for another snapshot = %v, %v", found, err)
+	}
+	if ok, err := s.AnomalyAcknowledged(1, 10); err != nil || ok {
+		t.Errorf("AnomalyAcknowledged before acknowledging = %v, %v", ok, err)
+	}
+	if found, err := s.AcknowledgeAnomalies(1, 10, 30); err != nil || !found {
+		t.Errorf("AcknowledgeAnomalies = %v, %v", found, err)
+	}
+	if ok, err := s.AnomalyAcknowledged(1, 10); err != nil || !ok {
+		t.Errorf("AnomalyAcknowledged = %v, %v", ok, err)
+	}
+	anomalies, err := s.Anomalies(time.Unix(0, 0), time.Unix(100, 0))
+	if err != nil || len(anomalies) != 1 || anomalies[0].Acknowledged != 30 {
+		t.Errorf("Anomalies = %v, %v", anomalies, err)
+	}
+}
+
+func TestSQLiteCollectSnapshots(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	s := newTestSQLiteDatabase(t)
+	// A delta and the full record that replaced it share a date.
+	for _, r := range []*followersRecord{
+		{Uid: 1, Date: 100, Followers: []int64{2, 3, 4}},
+		{Uid: 1, Date: 200, Delta: true, Base: 100, Removed: []int64{4}},
+		{Uid: 1, Date: 200, Followers: []int64{2, 3, 5}},
+	} {
+		if err := (sqliteTx{s.db}).insertRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := s.CollectSnapshots(RetentionPolicy{Latest: 1}, time.Unix(300, 0))
+	if err != nil || removed != 2 {
+		t.Errorf("CollectSnapshots = %v, %v; want 2 records removed", removed, err)
+	}
+	want := &userFollowers{1, 200, []int64{2, 3, 5}}
+	if uf, err := s.GetUserFollowers(1); err != nil || !reflect.DeepEqual(uf, want) {
+		t.Errorf("GetUserFollowers = %v, %v; want %v", uf, err, want)
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	dir, err := ioutil.TempDir("", "javaitarde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "old.db")
+
+	// A database from before schema versioning and delta encoding.
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE " + PREVIOUS_UNFOLLOWS_TABLE + " (uid INTEGER NOT NULL, unfollower INTEGER NOT NULL)",
+		"INSERT INTO " + PREVIOUS_UNFOLLOWS_TABLE + " VALUES (1, 2)",
+		"CREATE TABLE " + USER_FOLLOWERS_TABLE + " (uid INTEGER NOT NULL, date INTEGER NOT NULL, followers TEXT NOT NULL)",
+		"INSERT INTO " + USER_FOLLOWERS_TABLE + " VALUES (1, 10, '[2,3]')",
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	s, err := NewSQLiteDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := CheckSchema(s); err == nil {
+		t.Fatal("CheckSchema accepted an outdated database")
+	} else if e, ok := err.(*SchemaError); !ok || e.Version != 1 {
+		t.Fatalf("CheckSchema: got %v, want a SchemaError for version 1", err)
+	}
+	// Nothing was changed before the version was checked.
+	if err := s.db.QueryRow("SELECT delta FROM " + USER_FOLLOWERS_TABLE).Scan(new(int)); err == nil {
+		t.Error("the delta columns were added to an outdated database")
+	}
+	if hasIndexes, _ := s.exists("SELECT 1 FROM sqlite_master WHERE type = 'index' AND sql IS NOT NULL"); hasIndexes {
+		t.Error("indexes were created in an outdated database")
+	}
+	if err := Migrate(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(s); err != nil {
+		t.Fatalf("CheckSchema after Migrate: %v", err)
+	}
+	if !s.GetWasUnfollowNotified(1, 2) {
+		t.Error("migration lost previous_unfollows data")
+	}
+	if uf, err := s.GetUserFollowers(1); err != nil || uf == nil || len(uf.Followers) != 2 {
+		t.Errorf("migration lost user_followers data: %v, %v", uf, err)
+	}
+	if err := s.MarkUnfollowNotified(1, 3); err != nil {
+		t.Error(err)
+	}
+
+	// A newer database is rejected.
+	if err := s.setSchemaVersion(schemaVersion + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(s); err == nil {
+		t.Error("CheckSchema accepted a newer schema version")
+	}
+}
+
+func TestSQLiteIndexes(t *testing.T) {
+	defer func(d bool) { dryRunMode = d }(dryRunMode)
+	dryRunMode = false
+
+	s := newTestSQLiteDatabase(t)
+	if err := CheckSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	// CheckSchema already created them.
+	if created := ensureIndexes(s); len(created) != 0 {
+		t.Errorf("indexes created twice: %v", created)
+	}
+	if err := s.MarkUnfollowNotified(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkUnfollowNotified(1, 2); err == nil {
+		t.Error("the unique index on previous_unfollows allowed a duplicate")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// FollowersStore is the storage used by the crawler to keep follower
+// snapshots and the state of notifications and follow requests.
+// FollowersDatabase is the MongoDB implementation.
+type FollowersStore interface {
+	// GetUserFollowers returns the most recent followers snapshot for uid,
+	// or nil without an error if the user has never been saved.
+	GetUserFollowers(uid int64) (*userFollowers, error)
+	// Insert saves a new followers snapshot.
+	Insert(uf *userFollowers) error
+
+	MarkPendingFollow(uid int64) error
+	GetIsFollowingPending(uid int64) (bool, error)
+
+	// GetWasUnfollowNotified tells whether abandonedUser was already told
+	// that unfollower left, since the last time unfollower followed them
+	// again. Each follow episode gets its own notification.
+	GetWasUnfollowNotified(abandonedUser, unfollower int64) bool
+	MarkUnfollowNotified(abandonedUser, unfollower int64) error
+	// MarkRefollow records that follower follows abandonedUser again, and
+	// tells whether an unfollow of theirs was recorded since the last
+	// time, whatever its notification status. It also starts a new follow
+	// episode for the pair.
+	MarkRefollow(abandonedUser, follower int64) (wasUnfollower bool, err error)
+
+	// RecordUnfollowEvent adds e to the unfollow history.
+	RecordUnfollowEvent(e *UnfollowEvent) error
+	// UnfollowEventsByUser returns the unfollows of uid detected in
+	// [from, to), oldest first.
+	UnfollowEventsByUser(uid int64, from, to time.Time) ([]*UnfollowEvent, error)
+	// UnfollowEventsByUnfollower returns the unfollows made by unfollower
+	// and detected in [from, to), oldest first.
+	UnfollowEventsByUnfollower(unfollower int64, from, to time.Time) ([]*UnfollowEvent, error)
+
+	// GetUserSettings returns the settings of uid, or the defaults if
+	// there are none saved.
+	GetUserSettings(uid int64) (*UserSettings, error)
+	SaveUserSettings(s *UserSettings) error
+
+	// GetScreenName returns the cached screen name of uid and when it was
+	// fetched from twitter, or an empty name if it isn't cached.
+	GetScreenName(uid int64) (screenName string, fetched int64, err error)
+	SaveScreenName(uid int64, screenName string, fetched int64) error
+
+	// SuspectedUnfollows returns the suspected unfollows of uid.
+	SuspectedUnfollows(uid int64) ([]*SuspectedUnfollow, error)
+	// SaveSuspectedUnfollow adds s, or replaces the one for the same pair.
+	SaveSuspectedUnfollow(s *SuspectedUnfollow) error
+	ClearSuspectedUnfollow(uid, unfollower int64) error
+
+	RecordAnomaly(a *Anomaly) error
+	// Anomalies returns the anomalies detected in [from, to), oldest first.
+	Anomalies(from, to time.Time) ([]*Anomaly, error)
+	// AcknowledgeAnomalies marks the anomalies of uid found against its
+	// snapshot from prevSnapshotDate as acknowledged at the date at. It
+	// tells whether there were any.
+	AcknowledgeAnomalies(uid, prevSnapshotDate, at int64) (found bool, err error)
+	// AnomalyAcknowledged tells whether an anomaly of uid found against its
+	// snapshot from prevSnapshotDate was acknowledged.
+	AnomalyAcknowledged(uid, prevSnapshotDate int64) (bool, error)
+
+	// IgnoreList returns all the ignored users.
+	IgnoreList() ([]*IgnoreEntry, error)
+	SaveIgnoreEntry(e *IgnoreEntry) error
+	DeleteIgnoreEntry(e *IgnoreEntry) error
+
+	// LatestCrawlRun returns the run with the highest id, or nil if there
+	// is none.
+	LatestCrawlRun() (*CrawlRun, error)
+	// SaveCrawlRun adds r, or replaces the run with the same id.
+	SaveCrawlRun(r *CrawlRun) error
+	// MarkUserCrawled records that uid is done in the run with id run.
+	MarkUserCrawled(run, uid int64) error
+	// CrawledUsers returns the users marked as done in run.
+	CrawledUsers(run int64) ([]int64, error)
+	// ClearCrawledUsers forgets the users done in runs older than run.
+	ClearCrawledUsers(run int64) error
+
+	// FollowersPages returns the saved pages of the followers of uid, in
+	// order.
+	FollowersPages(uid int64) ([]*FollowersPage, error)
+	SaveFollowersPage(p *FollowersPage) error
+	DeleteFollowersPages(uid int64) error
+}
+
+var storeBackend string
+
+func init() {
+	flag.StringVar(&storeBackend, "store", "mongo",
+		"Storage backend: mongo, sqlite or memory (nothing is persisted).")
+}
+
+// NewFollowersStore opens the storage backend selected by the -store flag.
+// Once ctx is done, the mongo store stops trying to reconnect.
+func NewFollowersStore(ctx context.Context) (FollowersStore, error) {
+	switch storeBackend {
+	case "mongo":
+		return NewFollowersDatabase(ctx)
+	case "sqlite":
+		return NewSQLiteDatabase(sqlitePath)
+	case "memory":
+		return NewMemoryDatabase(), nil
+	}
+	return nil, fmt.Errorf("unknown -store backend %q", storeBackend)
+}
@@ -0,0 +1,116 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"flag"
+	"log"
+)
+
+var unfollowConfirmations int
+
+func init() {
+	flag.IntVar(&unfollowConfirmations, "unfollowConfirmations", 1,
+		"Number of consecutive crawls a follower must be missing from before the unfollow is notified.")
+}
+
+// SuspectedUnfollow is a follower missing from the latest snapshots of Uid,
+// who isn't considered gone until missing from -unfollowConfirmations of
+// them in a row. Until then, they are kept in the saved snapshots.
+type SuspectedUnfollow struct {
+	Uid        int64 `bson:"uid"`
+	Unfollower int64 `bson:"unfollower"`
+	// FirstMissing is the date of the first snapshot without Unfollower.
+	FirstMissing int64 `bson:"firstmissing"`
+	// Misses counts the snapshots in a row without Unfollower.
+	Misses int `bson:"misses"`
+}
+
+// suspectChanges are the updates to the suspected unfollows of a user made
+// by checkSuspected. They are saved with the snapshot, by saveSuspected, so
+// that a crawl whose snapshot isn't saved doesn't count as a miss.
+type suspectChanges struct {
+	save  []*SuspectedUnfollow
+	clear []int64
+}
+
+// checkSuspected applies the confirmation window to the unfollowers of u
+// found in newUf. It returns the ones that have been missing long enough,
+// and the ones that are still only suspected. Suspects that are back in
+// newUf are forgotten.
+func (c *FollowersCrawler) checkSuspected(u int64, newUf *userFollowers, unfollowers []int64) (confirmed, suspected []int64, changes suspectChanges) {
+	suspects, err := c.db.SuspectedUnfollows(u)
+	if err != nil {
+		log.Printf("SuspectedUnfollows failure, userId=%d. Err: %v", u, err)
+	}
+	if unfollowConfirmations <= 1 {
+		// Left from a higher -unfollowConfirmations. They are confirmed,
+		// or back.
+		for _, s := range suspects {
+			changes.clear = append(changes.clear, s.Unfollower)
+		}
+		return unfollowers, nil, changes
+	}
+	known := make(map[int64]*SuspectedUnfollow, len(suspects))
+	for _, s := range suspects {
+		known[s.Unfollower] = s
+	}
+	missing := make(map[int64]bool, len(unfollowers))
+	for _, unfollower := range unfollowers {
+		missing[unfollower] = true
+	}
+	for _, s := range suspects {
+		if !missing[s.Unfollower] {
+			changes.clear = append(changes.clear, s.Unfollower)
+		}
+	}
+
+	confirmed = make([]int64, 0, len(unfollowers))
+	for _, unfollower := range unfollowers {
+		s, ok := known[unfollower]
+		if !ok {
+			s = &SuspectedUnfollow{Uid: u, Unfollower: unfollower, FirstMissing: newUf.Date}
+		}
+		s.Misses++
+		if s.Misses < unfollowConfirmations {
+			suspected = append(suspected, unfollower)
+			changes.save = append(changes.save, s)
+			continue
+		}
+		confirmed = append(confirmed, unfollower)
+		if ok {
+			changes.clear = append(changes.clear, unfollower)
+		}
+	}
+	return
+}
+
+// saveSuspected records the changes checkSuspected made for u, once the
+// snapshot they come from is saved.
+func (c *FollowersCrawler) saveSuspected(u int64, changes suspectChanges) {
+	if dryRunMode {
+		return
+	}
+	for _, s := range changes.save {
+		if err := c.db.SaveSuspectedUnfollow(s); err != nil {
+			log.Printf("SaveSuspectedUnfollow failure, userId=%d, unfollower=%d. Err: %v", u, s.Unfollower, err)
+		}
+	}
+	for _, unfollower := range changes.clear {
+		if err := c.db.ClearSuspectedUnfollow(u, unfollower); err != nil {
+			log.Printf("ClearSuspectedUnfollow failure, userId=%d, unfollower=%d. Err: %v", u, unfollower, err)
+		}
+	}
+}
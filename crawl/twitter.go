@@ -15,6 +15,7 @@
 package javaitarde
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,75 +44,185 @@ var oauthClient = oauth.Client{
 
 type twitterClient struct {
 	twitterToken *oauth.Credentials
+	// apiBase is TWITTER_API_BASE, except in tests.
+	apiBase string
+	limits  *rateLimiter
 }
 
 func newTwitterClient() *twitterClient {
-	return &twitterClient{twitterToken: &oauth.Credentials{accessToken, accessTokenSecret}}
+	return &twitterClient{
+		twitterToken: &oauth.Credentials{accessToken, accessTokenSecret},
+		apiBase:      TWITTER_API_BASE,
+		limits:       newRateLimiter(),
+	}
 }
 
-func (tw *twitterClient) twitterGet(url string, param url.Values) (p []byte, err error) {
-	return tw.request("GET", url, param)
+func (tw *twitterClient) twitterGet(ctx context.Context, url string, param url.Values) (p []byte, err error) {
+	return tw.request(ctx, "GET", url, param)
 }
 
 // twitterPost issues a POST query to twitter to the given url, using parameters from param. The params must be URL
 // escaped already.
-func (tw *twitterClient) twitterPost(url string, param url.Values) (p []byte, err error) {
-	return tw.request("POST", url, param)
+func (tw *twitterClient) twitterPost(ctx context.Context, url string, param url.Values) (p []byte, err error) {
+	return tw.request(ctx, "POST", url, param)
 }
 
-func (tw *twitterClient) request(method string, url string, param url.Values) (p []byte, err error) {
+// request sends the query and reads the response. If the quota of the
+// endpoint was used up, it first waits for the rate limit to reset. It gives
+// up, returning ctx.Err(), as soon as ctx is done. It's safe to call from
+// several goroutines.
+func (tw *twitterClient) request(ctx context.Context, method string, url string, param url.Values) (p []byte, err error) {
+	endpoint := strings.TrimPrefix(url, tw.apiBase)
+	probe, err := tw.limits.wait(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
 	// I can't use POST for all requests. Certain API methods require GET too.
 	oauthClient.SignParam(tw.twitterToken, method, url, param)
-	var resp *http.Response
-	done := make(chan bool, 1)
+	reqCtx, cancel := context.WithTimeout(ctx, TWITTER_GET_TIMEOUT)
+	defer cancel()
+	var req *http.Request
 	// log.Printf("method %v, url %v, param %v", method, url, param)
 	switch method {
 	case "POST":
-		go func() {
-			resp, err = http.PostForm(url, param)
-			done <- true
-		}()
+		req, err = http.NewRequestWithContext(reqCtx, method, url, strings.NewReader(param.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
 	case "GET":
 		url = url + "?" + param.Encode()
-		go func() {
-			resp, err = http.Get(url)
-			done <- true
-		}()
+		req, err = http.NewRequestWithContext(reqCtx, method, url, nil)
 	}
-
-	timeout := time.After(TWITTER_GET_TIMEOUT)
-	select {
-	case <-done:
-		break
-	case <-timeout:
+	if err != nil {
+		tw.limits.update(endpoint, nil, probe)
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	tw.limits.update(endpoint, resp, probe)
+	if ctx.Err() != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if reqCtx.Err() == context.DeadlineExceeded {
+		if resp != nil {
+			resp.Body.Close()
+		}
 		return nil, fmt.Errorf("http %v timed out - %v", method, url)
 	}
 	return readHttpResponse(resp, err)
 }
 
-func (tw *twitterClient) verifyCredentials() error {
-	u := TWITTER_API_BASE + "/account/verify_credentials.json"
-	if _, err := tw.twitterGet(u, make(url.Values)); err != nil {
+func (tw *twitterClient) verifyCredentials(ctx context.Context) error {
+	u := tw.apiBase + "/account/verify_credentials.json"
+	if _, err := tw.twitterGet(ctx, u, make(url.Values)); err != nil {
 		return fmt.Errorf("verifyCredentials twitterGet error: %v", err)
 	}
 	return nil
 }
 
-func (tw *twitterClient) getUserName(uid int64) (screenName string, err error) {
+// twitterUser is the profile data returned by users/lookup.
+type twitterUser struct {
+	Id             int64  `json:"id"`
+	ScreenName     string `json:"screen_name"`
+	Name           string `json:"name"`
+	FollowersCount int    `json:"followers_count"`
+	Protected      bool   `json:"protected"`
+	Lang           string `json:"lang"`
+}
+
+// maxLookupUsers is how many users a single users/lookup call accepts.
+const maxLookupUsers = 100
+
+// lookupUsers returns the profiles of uids, making one request per 100 users.
+// Users that twitter doesn't return, because they are suspended or don't
+// exist, are missing from the result.
+func (tw *twitterClient) lookupUsers(ctx context.Context, uids []int64) (users map[int64]*twitterUser, err error) {
+	users = make(map[int64]*twitterUser, len(uids))
+	url_ := tw.apiBase + "/users/lookup.json"
+	for start := 0; start < len(uids); start += maxLookupUsers {
+		end := start + maxLookupUsers
+		if end > len(uids) {
+			end = len(uids)
+		}
+		ids := make([]string, 0, end-start)
+		for _, uid := range uids[start:end] {
+			ids = append(ids, strconv.FormatInt(uid, 10))
+		}
+		param := make(url.Values)
+		param.Set("user_id", strings.Join(ids, ","))
+		param.Set("include_entities", "false")
+		// POST, because the list of ids may not fit in a GET url.
+		resp, err := tw.twitterPost(ctx, url_, param)
+		if err != nil {
+			if isStatus(err, http.StatusNotFound) {
+				// None of the users exist.
+				continue
+			}
+			return users, fmt.Errorf("lookupUsers twitterPost error: %v", err)
+		}
+		var found []*twitterUser
+		if err = json.Unmarshal(resp, &found); err != nil {
+			return users, fmt.Errorf("lookupUsers unmarshal error: %v", err)
+		}
+		for _, u := range found {
+			users[u.Id] = u
+		}
+	}
+	return users, nil
+}
+
+// accountState tells why uid can't be found by users/lookup. It returns
+// ReasonUnfollowed if the account is actually fine.
+func (tw *twitterClient) accountState(ctx context.Context, uid int64) (reason string, err error) {
 	param := make(url.Values)
-	param.Set("id", strconv.FormatInt(uid, 10))
-	url := TWITTER_API_BASE + "/users/show.json"
+	param.Set("user_id", strconv.FormatInt(uid, 10))
+	param.Set("include_entities", "false")
+	_, err = tw.twitterGet(ctx, tw.apiBase+"/users/show.json", param)
+	if err == nil {
+		return ReasonUnfollowed, nil
+	}
+	apiErr, ok := err.(*twitterAPIError)
+	if !ok {
+		return "", err
+	}
+	switch {
+	case apiErr.hasCode(twitterUserSuspended):
+		return ReasonSuspended, nil
+	case apiErr.hasCode(twitterUserNotFound):
+		// Twitter says "not found" for deactivated accounts. This one
+		// existed, since it was following someone.
+		return ReasonDeactivated, nil
+	case apiErr.StatusCode == 404:
+		return ReasonNotFound, nil
+	}
+	return "", err
+}
+
+type friendship struct {
+	Relationship struct {
+		Source struct {
+			Following bool
+		}
+	}
+}
 
-	userDetails := map[string]interface{}{}
-	resp, err := tw.twitterGet(url, param)
+// isFollowing tells whether source follows target, according to
+// friendships/show.
+func (tw *twitterClient) isFollowing(ctx context.Context, source, target int64) (bool, error) {
+	param := make(url.Values)
+	param.Set("source_id", strconv.FormatInt(source, 10))
+	param.Set("target_id", strconv.FormatInt(target, 10))
+	resp, err := tw.twitterGet(ctx, tw.apiBase+"/friendships/show.json", param)
 	if err != nil {
-		return
+		return false, fmt.Errorf("isFollowing twitterGet error: %v", err)
 	}
-	if err = json.Unmarshal(resp, &userDetails); err != nil {
-		return
+	var f friendship
+	if err = json.Unmarshal(resp, &f); err != nil {
+		return false, fmt.Errorf("isFollowing unmarshal error: %v", err)
 	}
-	screenName = userDetails["screen_name"].(string)
-	return
+	return f.Relationship.Source.Following, nil
 }
 
 type userFollowers struct {
@@ -121,8 +232,8 @@ type userFollowers struct {
 }
 
 type getFollowersResult struct {
-	Ids        []int64 `bson:"ids"`
-	NextCursor int64   `bson:"next_cursor"`
+	Ids        []int64 `json:"ids"`
+	NextCursor int64   `json:"next_cursor"`
 }
 
 type NotAuthorizedError struct{}
@@ -131,103 +242,167 @@ func (NotAuthorizedError) Error() string {
 	return "twitter: Not Authorized"
 }
 
-// getUserFollowers retrieves the followers of a user. If uid != 0, uses the uid for searching, otherwise searches by
-// screenName.
-func (tw *twitterClient) getUserFollowers(uid int64, screenName string) (uf *userFollowers, err error) {
+// getFollowersPage retrieves one page of the followers of uid, starting at
+// cursor, and returns the cursor of the next page. The first page is at
+// cursor -1, and the next cursor is 0 after the last page.
+func (tw *twitterClient) getFollowersPage(ctx context.Context, uid, cursor int64) (ids []int64, next int64, err error) {
 	param := make(url.Values)
-	if uid != 0 {
-		param.Set("id", strconv.FormatInt(uid, 10))
-	} else {
-		param.Set("screen_name", screenName)
+	param.Set("id", strconv.FormatInt(uid, 10))
+	param.Set("cursor", strconv.FormatInt(cursor, 10))
+	resp, err := tw.twitterGet(ctx, tw.apiBase+"/followers/ids.json", param)
+	if err != nil {
+		if isStatus(err, http.StatusUnauthorized) {
+			return nil, 0, NotAuthorizedError{}
+		}
+		return nil, 0, fmt.Errorf("getFollowersPage twitterGet error: %v", err)
+	}
+	var result getFollowersResult
+	if err = json.Unmarshal(resp, &result); err != nil {
+		log.Println("unmarshal error", err.Error())
+		log.Println("output was:", string(resp))
+		return nil, 0, err
 	}
+	return result.Ids, result.NextCursor, nil
+}
 
-	var (
-		followers []int64
-		resp      []byte
-		url       = TWITTER_API_BASE + "/followers/ids.json"
-		cursor    = int64(-1)
-		result    getFollowersResult
-	)
-
-	for {
-		param.Set("cursor", strconv.FormatInt(cursor, 10))
-		resp, err = tw.twitterGet(url, param)
-		if err != nil {
-			if strings.Contains(err.Error(), " 401") {
-				err = NotAuthorizedError{}
-				return
-			}
-			return nil, fmt.Errorf("getUserFollowers twitterGet error: %v", err)
-		}
+func (tw *twitterClient) NotifyUnfollower(ctx context.Context, abandonedName, unfollowerName string) (err error) {
+	// TODO: translate messages.
+	text := fmt.Sprintf("Xiiii.. você não está mais sendo seguido por @%s :-(.", unfollowerName)
+	if err = tw.sendDirectMessage(ctx, abandonedName, text); err == nil {
+		log.Printf("Notified %v of unfollow by %v", abandonedName, unfollowerName)
+	}
+	return
+}
 
-		if err = json.Unmarshal(resp, &result); err != nil {
-			log.Println("unmarshal error", err.Error())
-			log.Println("output was:", string(resp))
-			return
-		}
-		if len(result.Ids) == 0 {
-			err = errors.New("no followers.")
-			return
+func (tw *twitterClient) NotifyDeparted(ctx context.Context, abandonedName, followerName, reason string) (err error) {
+	var text string
+	switch reason {
+	case ReasonSuspended:
+		text = fmt.Sprintf("A conta de @%s foi suspensa pelo twitter, por isso não está mais te seguindo.", followerName)
+	case ReasonDeactivated:
+		text = fmt.Sprintf("@%s desativou a conta, por isso não está mais te seguindo.", followerName)
+	default:
+		text = fmt.Sprintf("A conta de @%s não existe mais, por isso não está mais te seguindo.", followerName)
+	}
+	if err = tw.sendDirectMessage(ctx, abandonedName, text); err == nil {
+		log.Printf("Notified %v that %v is gone (%v)", abandonedName, followerName, reason)
+	}
+	return
+}
+
+func (tw *twitterClient) NotifyRefollower(ctx context.Context, abandonedName, followerName string) (err error) {
+	text := fmt.Sprintf("Oba! @%s voltou a te seguir :-).", followerName)
+	if err = tw.sendDirectMessage(ctx, abandonedName, text); err == nil {
+		log.Printf("Notified %v of refollow by %v", abandonedName, followerName)
+	}
+	return
+}
+
+// maxNamesPerMessage limits how many followers are listed in a single
+// message about new followers.
+const maxNamesPerMessage = 20
+
+func (tw *twitterClient) NotifyNewFollowers(ctx context.Context, userName string, followerNames []string) (err error) {
+	var text string
+	if len(followerNames) == 1 {
+		text = fmt.Sprintf("Oba! @%s começou a te seguir :-).", followerNames[0])
+	} else {
+		shown := followerNames
+		if len(shown) > maxNamesPerMessage {
+			shown = shown[:maxNamesPerMessage]
 		}
-		followers = append(followers, result.Ids...)
-		if result.NextCursor == 0 {
-			// Done.
-			break
+		text = "Oba! Novos seguidores: @" + strings.Join(shown, ", @")
+		if more := len(followerNames) - len(shown); more > 0 {
+			text += fmt.Sprintf(" e mais %d", more)
 		}
-		cursor = result.NextCursor
+		text += " :-)."
+	}
+	if err = tw.sendDirectMessage(ctx, userName, text); err == nil {
+		log.Printf("Notified %v of %d new followers", userName, len(followerNames))
 	}
-	uf = &userFollowers{uid, time.Now().UTC().Unix(), followers}
 	return
 }
 
-func (tw *twitterClient) NotifyUnfollower(abandonedName, unfollowerName string) (err error) {
-	// TODO: Should be "sendDirectMessage".
-	url_ := TWITTER_API_BASE + "/direct_messages/new.json"
+func (tw *twitterClient) sendDirectMessage(ctx context.Context, screenName, text string) (err error) {
+	url_ := tw.apiBase + "/direct_messages/new.json"
 	param := make(url.Values)
-	param.Set("screen_name", abandonedName)
-	// TODO: translate messages.
-	param.Set("text", fmt.Sprintf("Xiiii.. você não está mais sendo seguido por @%s :-(.", unfollowerName))
+	param.Set("screen_name", screenName)
+	param.Set("text", text)
 
-	p, err := tw.twitterPost(url_, param)
+	p, err := tw.twitterPost(ctx, url_, param)
 	if err != nil {
-		log.Println("notify unfollower error:", err.Error())
+		log.Println("direct message error:", err.Error())
 		log.Println("response", string(p))
-	} else {
-		log.Printf("Notified %v of unfollow by %v", abandonedName, unfollowerName)
 	}
 	return
 }
 
-func (tw *twitterClient) FollowUser(uid int64) (err error) {
-	url_ := TWITTER_API_BASE + "/friendships/create.json"
+func (tw *twitterClient) FollowUser(ctx context.Context, uid int64) (err error) {
+	url_ := tw.apiBase + "/friendships/create.json"
 	param := make(url.Values)
 	param.Set("user_id", strconv.FormatInt(uid, 10))
 	param.Set("follow", "true")
-	_, err = tw.twitterPost(url_, param)
+	_, err = tw.twitterPost(ctx, url_, param)
 	return
 }
 
 type twitterErrorMsg struct {
 	Message string
+	Code    int
 }
 
 type twitterError struct {
 	Errors []twitterErrorMsg
 }
 
-func parseResponseError(p []byte) string {
+// Twitter API error codes.
+const (
+	twitterUserNotFound  = 50
+	twitterUserSuspended = 63
+)
+
+// twitterAPIError is returned for responses with a status other than 200.
+type twitterAPIError struct {
+	StatusCode int
+	// Codes are the twitter error codes found in the response.
+	Codes []int
+	Msg   string
+}
+
+func (e *twitterAPIError) Error() string {
+	return fmt.Sprintf("Server Error code: %d; msg: %v", e.StatusCode, e.Msg)
+}
+
+// isStatus reports whether err is a *twitterAPIError with the given HTTP
+// status.
+func isStatus(err error, status int) bool {
+	var apiErr *twitterAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+func (e *twitterAPIError) hasCode(code int) bool {
+	for _, c := range e.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func parseResponseError(p []byte) (msg string, codes []int) {
 	// {"errors":[{"message":"Rate limit exceeded","code":88}]}
 	var r twitterError
 	if err := json.Unmarshal(p, &r); err != nil {
 		log.Printf("parseResponseError json.Unmarshal error: %v", err)
 		log.Printf("full response:\n======\n%v\n========", string(p))
-		return ""
+		return "", nil
 	}
 	errorMsg := make([]string, 0, 1)
 	for _, msg := range r.Errors {
 		errorMsg = append(errorMsg, msg.Message)
+		codes = append(codes, msg.Code)
 	}
-	return fmt.Sprintf("%v", errorMsg)
+	return fmt.Sprintf("%v", errorMsg), codes
 
 }
 
@@ -244,49 +419,16 @@ func readHttpResponse(resp *http.Response, httpErr error) (p []byte, err error)
 	}
 	p, err = ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	rateLimit(resp)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		e := parseResponseError(p)
+		e, codes := parseResponseError(p)
 		if e == "" {
 			e = "unknown"
 		}
-		err = errors.New(fmt.Sprintf("Server Error code: %d; msg: %v", resp.StatusCode, e))
-		return nil, err
+		return nil, &twitterAPIError{resp.StatusCode, codes, e}
 	}
 	return p, nil
 
 }
-
-// rateLimit blocks the execution if the request quota with twitter was
-// execeeded. It unblocks when the quota is reset.
-func rateLimit(resp *http.Response) {
-	if resp == nil {
-		return
-	}
-	// if resp.StatusCode == 429 { // Rate limit exceeded
-	//	log.Println("Got rate limited. Printing headers")
-	// 	log.Printf("%v", resp.Header)
-	// }
-	curr := time.Now().UTC()
-	// 1.0 was "RateLimit" instead of "Rate-Limit"
-	hreset := resp.Header.Get("X-Rate-Limit-Reset")
-	hremaining := resp.Header.Get("X-Rate-Limit-Remaining")
-	if hreset == "" || hremaining == "" {
-		return
-	}
-	remaining, _ := strconv.ParseInt(hremaining, 10, 64)
-	r, _ := strconv.ParseInt(hreset, 10, 64)
-	reset := time.Unix(r, 0)
-	if remaining < 1 && !reset.IsZero() {
-		sleep := reset.Sub(curr)
-		if sleep > 0 {
-			log.Printf("Twitter API limits exceeded. Sleeping for %v.\n", sleep)
-			time.Sleep(sleep)
-			return
-		}
-		log.Printf("Rate limited by twitter but X-RateLimit-Reset is in the past: block should have expired %v ago (timestamp: %v)", time.Since(reset), hreset)
-	}
-}
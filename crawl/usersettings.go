@@ -0,0 +1,61 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package javaitarde
+
+import (
+	"fmt"
+	"log"
+)
+
+// How a user wants to hear about new followers.
+const (
+	// Don't tell (the default).
+	NewFollowersOff = "off"
+	// One message per new follower.
+	NewFollowersEach = "each"
+	// One message per crawl listing all the new followers.
+	NewFollowersBatch = "batch"
+)
+
+// UserSettings has the per user options.
+type UserSettings struct {
+	Uid          int64  `bson:"uid"`
+	NewFollowers string `bson:"newfollowers"`
+}
+
+func defaultUserSettings(uid int64) *UserSettings {
+	return &UserSettings{Uid: uid, NewFollowers: NewFollowersOff}
+}
+
+// SetNewFollowersMode changes how uid is told about new followers. mode is
+// one of the NewFollowers* constants.
+func SetNewFollowersMode(db FollowersStore, uid int64, mode string) error {
+	switch mode {
+	case NewFollowersOff, NewFollowersEach, NewFollowersBatch:
+	default:
+		return fmt.Errorf("unknown new followers mode %q, want %v, %v or %v",
+			mode, NewFollowersOff, NewFollowersEach, NewFollowersBatch)
+	}
+	settings, err := db.GetUserSettings(uid)
+	if err != nil {
+		return err
+	}
+	if dryRunMode {
+		log.Printf("dryRunMode, not changing the new followers mode of %d from %q to %q", uid, settings.NewFollowers, mode)
+		return nil
+	}
+	settings.NewFollowers = mode
+	return db.SaveUserSettings(settings)
+}
@@ -15,29 +15,273 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	javaitarde "github.com/nictuku/javaitarde/crawl"
 	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 var (
 	hubUserUid      int64
 	runContinuously bool
+	gcAfterCrawl    bool
+	historySince    time.Duration
+	crawlInterval   time.Duration
+	crawlJitter     time.Duration
 )
 
 func init() {
 	flag.Int64Var(&hubUserUid, "hubuid", 217554981,
 		"Uid of our user, whose followers we want to track for unfollows.")
+	flag.BoolVar(&runContinuously, "daemon", false,
+		"Keep running, and crawl every -interval.")
+	flag.DurationVar(&crawlInterval, "interval", 8*time.Hour,
+		"Time between the start of two crawls, with -daemon.")
+	flag.DurationVar(&crawlJitter, "jitter", 10*time.Minute,
+		"Up to this much time is randomly added to -interval, so crawls don't always hit twitter at the same time.")
+	flag.BoolVar(&gcAfterCrawl, "gcAfterCrawl", false,
+		"Garbage collect old followers snapshots after crawling.")
+	flag.DurationVar(&historySince, "historySince", 30*24*time.Hour,
+		"How far back the history and anomalies commands look.")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  anomalies  list the crawls that were set aside, e.g. for -maxUnfollows\n")
+	fmt.Fprintf(os.Stderr, "  anomalies ack uid: the anomaly of uid is real, let its next crawl go through\n")
+	fmt.Fprintf(os.Stderr, "  crawl    look for unfollows and notify users (default), forever with -daemon\n")
+	fmt.Fprintf(os.Stderr, "  gc       remove old followers snapshots, see the -keep* flags\n")
+	fmt.Fprintf(os.Stderr, "  history  uid: list the unfollows of a user, and the ones made by them\n")
+	fmt.Fprintf(os.Stderr, "  ignore   list | add uid watched|unfollower | remove uid watched|unfollower:\n")
+	fmt.Fprintf(os.Stderr, "           manage the users the crawler ignores\n")
+	fmt.Fprintf(os.Stderr, "  migrate  upgrade the database to the current schema version\n")
+	fmt.Fprintf(os.Stderr, "  newfollowers  uid off|each|batch: how to tell a user about new followers\n\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	crawler := javaitarde.NewFollowersCrawler()
-	if err := crawler.FindOurUsers(hubUserUid); err != nil {
-		log.Fatal("crawler.FindOurUsers:", err)
+	cmd := flag.Arg(0)
+	ctx := context.Background()
+	if cmd == "" || cmd == "crawl" {
+		// SIGINT or SIGTERM stop the crawl once the users being
+		// notified are done. A second one kills the program.
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+	}
+	db, err := javaitarde.NewFollowersStore(ctx)
+	if err != nil {
+		log.Fatal("NewFollowersStore:", err)
+	}
+	if cmd == "migrate" {
+		if err := javaitarde.Migrate(db); err != nil {
+			log.Fatal("Migrate:", err)
+		}
+		return
+	}
+	if err := javaitarde.CheckSchema(db); err != nil {
+		log.Fatal(err)
+	}
+	switch cmd {
+	case "", "crawl":
+		if runContinuously {
+			daemon(ctx, db)
+		} else if err := crawl(ctx, db); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatal(err)
+		}
+		if ctx.Err() != nil {
+			log.Println("Interrupted, exiting")
+		}
+	case "anomalies":
+		anomalies(db)
+	case "gc":
+		if _, err := javaitarde.CollectSnapshots(db); err != nil {
+			log.Fatal("CollectSnapshots:", err)
+		}
+	case "history":
+		uid, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if err != nil {
+			log.Fatal("history: bad uid: ", err)
+		}
+		history(db, uid)
+	case "ignore":
+		ignore(db)
+	case "newfollowers":
+		uid, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if err != nil {
+			log.Fatal("newfollowers: bad uid: ", err)
+		}
+		if err := javaitarde.SetNewFollowersMode(db, uid, flag.Arg(2)); err != nil {
+			log.Fatal("SetNewFollowersMode:", err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func crawl(ctx context.Context, db javaitarde.FollowersStore) error {
+	crawler := javaitarde.NewFollowersCrawler(db)
+	if err := crawler.FindOurUsers(ctx, hubUserUid); err != nil {
+		return fmt.Errorf("crawler.FindOurUsers: %w", err)
+	}
+	if err := crawler.GetAllUsersFollowers(ctx); err != nil {
+		return fmt.Errorf("crawler.GetAllUsersFollowers: %w", err)
+	}
+	if gcAfterCrawl {
+		if _, err := javaitarde.CollectSnapshots(db); err != nil {
+			log.Println("CollectSnapshots:", err)
+		}
+	}
+	return nil
+}
+
+// daemon crawls every crawlInterval, plus jitter, until ctx is done.
+func daemon(ctx context.Context, db javaitarde.FollowersStore) {
+	runEvery(ctx, crawlInterval, crawlJitter, func(ctx context.Context) error {
+		return crawl(ctx, db)
+	})
+}
+
+// runEvery runs crawl every interval, plus up to jitter, until ctx is done. A
+// crawl that fails is logged and the next one happens on schedule.
+func runEvery(ctx context.Context, interval, jitter time.Duration, crawl func(context.Context) error) {
+	for {
+		start := time.Now()
+		log.Println("Starting crawl")
+		if err := crawl(ctx); err != nil {
+			log.Println("Crawl failed:", err)
+		} else {
+			log.Printf("Crawl finished in %v", time.Since(start))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		next := nextCrawl(start, time.Now(), interval, jitter)
+		log.Printf("Next crawl at %v", next.Format(time.RFC3339))
+		t := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// nextCrawl returns when the crawl after the one that started at start
+// should happen. Crawls can't overlap: if the last one took longer than
+// interval, the crawls that should have started meanwhile are skipped.
+func nextCrawl(start, now time.Time, interval, jitter time.Duration) time.Time {
+	next := start.Add(interval)
+	skipped := 0
+	for interval > 0 && next.Before(now) {
+		next = next.Add(interval)
+		skipped++
+	}
+	if skipped > 0 {
+		log.Printf("The crawl took longer than -interval, skipping %d crawls", skipped)
+	}
+	if jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+func anomalies(db javaitarde.FollowersStore) {
+	switch flag.Arg(1) {
+	case "", "list":
+	case "ack":
+		uid, err := strconv.ParseInt(flag.Arg(2), 10, 64)
+		if err != nil {
+			log.Fatal("anomalies ack: bad uid: ", err)
+		}
+		if err := javaitarde.AcknowledgeAnomaly(db, uid); err != nil {
+			log.Fatal("AcknowledgeAnomaly: ", err)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown anomalies command %q\n", flag.Arg(1))
+		flag.Usage()
+		os.Exit(2)
+	}
+	to := time.Now()
+	from := to.Add(-historySince)
+	anomalies, err := db.Anomalies(from, to)
+	if err != nil {
+		log.Fatal("Anomalies:", err)
+	}
+	fmt.Printf("Anomalies (since %v):\n", from.Format(time.RFC3339))
+	for _, a := range anomalies {
+		fmt.Println(" ", a)
+	}
+}
+
+func ignore(db javaitarde.FollowersStore) {
+	switch flag.Arg(1) {
+	case "", "list":
+		entries, err := db.IgnoreList()
+		if err != nil {
+			log.Fatal("IgnoreList:", err)
+		}
+		for _, e := range entries {
+			fmt.Println(e.Uid, e.Scope)
+		}
+		return
+	case "add", "remove":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown ignore command %q\n", flag.Arg(1))
+		flag.Usage()
+		os.Exit(2)
+	}
+	uid, err := strconv.ParseInt(flag.Arg(2), 10, 64)
+	if err != nil {
+		log.Fatal("ignore: bad uid: ", err)
+	}
+	if flag.Arg(1) == "add" {
+		err = javaitarde.AddIgnore(db, uid, flag.Arg(3))
+	} else {
+		err = javaitarde.RemoveIgnore(db, uid, flag.Arg(3))
+	}
+	if err != nil {
+		log.Fatal("ignore: ", err)
+	}
+}
+
+func history(db javaitarde.FollowersStore, uid int64) {
+	to := time.Now()
+	from := to.Add(-historySince)
+	events, err := db.UnfollowEventsByUser(uid, from, to)
+	if err != nil {
+		log.Fatal("UnfollowEventsByUser:", err)
+	}
+	fmt.Printf("Unfollowed by (since %v):\n", from.Format(time.RFC3339))
+	for _, e := range events {
+		fmt.Println(" ", e)
+	}
+	if events, err = db.UnfollowEventsByUnfollower(uid, from, to); err != nil {
+		log.Fatal("UnfollowEventsByUnfollower:", err)
 	}
-	if err := crawler.GetAllUsersFollowers(); err != nil {
-		log.Fatal("crawler.GetAllUsersFollowers:", err)
+	fmt.Printf("Unfollowed (since %v):\n", from.Format(time.RFC3339))
+	for _, e := range events {
+		fmt.Println(" ", e)
 	}
 }
@@ -0,0 +1,87 @@
+// Copyright 2010 Yves Junqueira
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextCrawl(t *testing.T) {
+	start := time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		took time.Duration
+		want time.Duration
+	}{
+		{time.Hour, 8 * time.Hour},
+		{8 * time.Hour, 8 * time.Hour},
+		// The crawls at 8h and 16h are skipped.
+		{17 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		got := nextCrawl(start, start.Add(tt.took), 8*time.Hour, 0)
+		if want := start.Add(tt.want); !got.Equal(want) {
+			t.Errorf("crawl that took %v: next at %v, want %v", tt.took, got, want)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		got := nextCrawl(start, start.Add(time.Hour), 8*time.Hour, 10*time.Minute)
+		if min := start.Add(8 * time.Hour); got.Before(min) || !got.Before(min.Add(10*time.Minute)) {
+			t.Fatalf("next crawl at %v, want within 10m of %v", got, min)
+		}
+	}
+}
+
+func TestRunEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawls := 0
+	runEvery(ctx, time.Millisecond, 0, func(ctx context.Context) error {
+		crawls++
+		if crawls == 3 {
+			cancel()
+		}
+		// Failures don't stop the schedule.
+		return errors.New("twitter is down")
+	})
+	if crawls != 3 {
+		t.Errorf("got %d crawls, want 3", crawls)
+	}
+}
+
+func TestRunEveryCanceledWhileWaiting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	crawls := 0
+	done := make(chan bool)
+	go func() {
+		runEvery(ctx, time.Hour, 0, func(ctx context.Context) error {
+			crawls++
+			return nil
+		})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runEvery kept waiting for the next crawl after ctx was canceled")
+	}
+	if crawls != 1 {
+		t.Errorf("got %d crawls, want 1", crawls)
+	}
+}